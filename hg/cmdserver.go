@@ -0,0 +1,237 @@
+package hg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// A long-lived `hg serve --cmdserver pipe` process that runs hg commands
+// without paying the startup cost of a new hg process for each of them. See
+// `hg help internals.commandserver` for the channel protocol.
+//
+// The server is started outside of any repository, so that each command
+// opens the repository given with --cwd, just like a separate hg process.
+type CommandServer struct {
+	process *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	env     []string
+	closed  bool
+}
+
+// env is added to the environment of the server, e.g. HttpAuth.Env().
+func StartCommandServer(env []string) (*CommandServer, error) {
+	server := &CommandServer{env: env}
+	err := server.start()
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+func (self *CommandServer) start() error {
+	self.process = exec.Command("hg", "serve", "--cmdserver", "pipe")
+	if len(self.env) > 0 {
+		self.process.Env = append(os.Environ(), self.env...)
+	}
+	self.process.Stderr = os.Stderr
+
+	var err error
+	self.stdin, err = self.process.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("Error starting hg command server: %s", err)
+	}
+	stdout, err := self.process.StdoutPipe()
+	if err != nil {
+		self.stdin = nil
+		return fmt.Errorf("Error starting hg command server: %s", err)
+	}
+	self.stdout = bufio.NewReader(stdout)
+
+	err = self.process.Start()
+	if err != nil {
+		self.stdin = nil
+		return fmt.Errorf("Error starting hg command server: %s", err)
+	}
+
+	err = self.readHello()
+	if err != nil {
+		self.stop()
+		return fmt.Errorf("Error starting hg command server: %s", err)
+	}
+	return nil
+}
+
+// Stops the server for good, later commands fail.
+func (self *CommandServer) Close() error {
+	self.closed = true
+	return self.stop()
+}
+
+// The server exits once its input is closed.
+func (self *CommandServer) stop() error {
+	if self.stdin == nil {
+		return nil
+	}
+
+	self.stdin.Close()
+	self.stdin = nil
+	if self.process == nil {
+		return nil
+	}
+	return self.process.Wait()
+}
+
+// Runs an hg command as a Runner. The command itself is ignored, as the
+// server is always hg. The server cannot change its environment, so env
+// must be empty or the one the server was started with.
+//
+// A running command cannot be interrupted, so the server is stopped when ctx
+// is done before the command finishes, just like a separate hg process is
+// killed, and a new server is started for the next command, e.g. a retry.
+func (self *CommandServer) Run(ctx context.Context, command string, args []string, env []string, dir string, stdout io.Writer, stderr io.Writer) (exitCode int, err error) {
+	if self.closed {
+		return 0, fmt.Errorf("Error running hg %s: command server is not running", args[0])
+	}
+	if len(env) > 0 && !reflect.DeepEqual(env, self.env) {
+		return 0, fmt.Errorf("Error running hg %s: command server does not support setting the environment", args[0])
+	}
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	if self.stdin == nil {
+		err = self.start()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(dir) > 0 {
+		args = append([]string{args[0], "--cwd", dir}, args[1:]...)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func(stdin io.Closer) {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			if self.process != nil && self.process.Process != nil {
+				self.process.Process.Kill()
+			}
+			stdin.Close()
+		case <-done:
+		}
+	}(self.stdin)
+	defer func() {
+		close(done)
+		<-stopped
+		if ctx.Err() != nil && self.stdin != nil {
+			self.stdin = nil
+			if self.process != nil {
+				self.process.Wait()
+			}
+			err = ctx.Err()
+		}
+	}()
+
+	err = self.writeCommand("runcommand", []byte(strings.Join(args, "\x00")))
+	if err != nil {
+		return 0, fmt.Errorf("Error sending hg %s to command server: %s", args[0], err)
+	}
+
+	for {
+		channel, data, err := self.readChannel()
+		if err != nil {
+			return 0, fmt.Errorf("Error reading hg %s output from command server: %s", args[0], err)
+		}
+
+		switch channel {
+		case 'o':
+			stdout.Write(data)
+		case 'e':
+			stderr.Write(data)
+		case 'r':
+			if len(data) != 4 {
+				return 0, fmt.Errorf("Error reading hg %s exit code from command server", args[0])
+			}
+			exitCode = int(int32(binary.BigEndian.Uint32(data)))
+			return exitCode, nil
+		case 'I', 'L':
+			// there is no terminal to ask for input, reply with end of input
+			err = binary.Write(self.stdin, binary.BigEndian, uint32(0))
+			if err != nil {
+				return 0, fmt.Errorf("Error sending input to hg %s: %s", args[0], err)
+			}
+		default:
+			// unknown channels are only allowed if optional, i.e. lowercase
+			if unicode.IsUpper(rune(channel)) {
+				return 0, fmt.Errorf("Error running hg %s: unsupported command server channel '%c'", args[0], channel)
+			}
+		}
+	}
+}
+
+// The server announces its capabilities on the output channel after start.
+func (self *CommandServer) readHello() error {
+	channel, data, err := self.readChannel()
+	if err != nil {
+		return err
+	}
+	if channel != 'o' {
+		return fmt.Errorf("unexpected hello on channel '%c'", channel)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "capabilities:") {
+			for _, capability := range strings.Fields(strings.TrimPrefix(line, "capabilities:")) {
+				if capability == "runcommand" {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("server does not support runcommand")
+}
+
+func (self *CommandServer) writeCommand(command string, data []byte) error {
+	var request bytes.Buffer
+	request.WriteString(command + "\n")
+	binary.Write(&request, binary.BigEndian, uint32(len(data)))
+	request.Write(data)
+
+	_, err := self.stdin.Write(request.Bytes())
+	return err
+}
+
+// Reads a message, which is the channel identifier, followed by the length
+// of the data as a big endian uint32, and the data. For the input channels,
+// the length is the number of bytes requested and there is no data.
+func (self *CommandServer) readChannel() (channel byte, data []byte, err error) {
+	channel, err = self.stdout.ReadByte()
+	if err != nil {
+		return
+	}
+
+	var length uint32
+	err = binary.Read(self.stdout, binary.BigEndian, &length)
+	if err != nil {
+		return
+	}
+
+	if channel == 'I' || channel == 'L' {
+		return
+	}
+
+	data = make([]byte, length)
+	_, err = io.ReadFull(self.stdout, data)
+	return
+}
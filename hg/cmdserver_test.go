@@ -0,0 +1,191 @@
+package hg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CommandServer", func() {
+	Context("When talking to a fake server", func() {
+		var server *CommandServer
+		var requests chan []string
+
+		writeMessage := func(writer io.Writer, channel byte, data []byte) {
+			writer.Write([]byte{channel})
+			binary.Write(writer, binary.BigEndian, uint32(len(data)))
+			writer.Write(data)
+		}
+
+		writeExitCode := func(writer io.Writer, exitCode int32) {
+			data := make([]byte, 4)
+			binary.BigEndian.PutUint32(data, uint32(exitCode))
+			writeMessage(writer, 'r', data)
+		}
+
+		BeforeEach(func() {
+			requests = make(chan []string, 10)
+			clientReader, serverWriter := io.Pipe()
+			serverReader, clientWriter := io.Pipe()
+
+			go func() {
+				defer GinkgoRecover()
+				defer serverWriter.Close()
+
+				input := bufio.NewReader(serverReader)
+				writeMessage(serverWriter, 'o', []byte("capabilities: getencoding runcommand\nencoding: UTF-8"))
+				for {
+					command, err := input.ReadString('\n')
+					if err != nil {
+						return
+					}
+					Expect(command).To(Equal("runcommand\n"))
+
+					var length uint32
+					Expect(binary.Read(input, binary.BigEndian, &length)).To(Succeed())
+					data := make([]byte, length)
+					_, err = io.ReadFull(input, data)
+					Expect(err).To(BeNil())
+
+					args := strings.Split(string(data), "\x00")
+					requests <- args
+					switch args[0] {
+					case "log":
+						writeMessage(serverWriter, 'd', []byte("debug output"))
+						writeMessage(serverWriter, 'o', []byte("some "))
+						writeMessage(serverWriter, 'e', []byte("warning "))
+						writeMessage(serverWriter, 'o', []byte("output"))
+						writeExitCode(serverWriter, 0)
+					case "commit":
+						// asks for a commit message, and fails without one
+						serverWriter.Write([]byte{'L'})
+						binary.Write(serverWriter, binary.BigEndian, uint32(4096))
+						var inputLength uint32
+						Expect(binary.Read(input, binary.BigEndian, &inputLength)).To(Succeed())
+						Expect(inputLength).To(Equal(uint32(0)))
+						writeMessage(serverWriter, 'e', []byte("abort: empty commit message\n"))
+						writeExitCode(serverWriter, 255)
+					default:
+						writeMessage(serverWriter, 'X', []byte{})
+					}
+				}
+			}()
+
+			server = &CommandServer{stdin: clientWriter, stdout: bufio.NewReader(clientReader)}
+			Expect(server.readHello()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("separates output and error, and passes the working directory", func() {
+			var stdout, stderr bytes.Buffer
+			exitCode, err := server.Run(ctx, "hg", []string{"log", "--rev", "tip"}, nil, "/some/repo", &stdout, &stderr)
+			Expect(err).To(BeNil())
+			Expect(exitCode).To(Equal(0))
+			Expect(stdout.String()).To(Equal("some output"))
+			Expect(stderr.String()).To(Equal("warning "))
+			Expect(<-requests).To(Equal([]string{"log", "--cwd", "/some/repo", "--rev", "tip"}))
+		})
+
+		It("answers input requests with end of input, and reports exit codes", func() {
+			var stderr bytes.Buffer
+			exitCode, err := server.Run(ctx, "hg", []string{"commit"}, nil, "", ioutil.Discard, &stderr)
+			Expect(err).To(BeNil())
+			Expect(exitCode).To(Equal(255))
+			Expect(stderr.String()).To(Equal("abort: empty commit message\n"))
+		})
+
+		It("fails on unknown required channels", func() {
+			_, err := server.Run(ctx, "hg", []string{"bogus"}, nil, "", ioutil.Discard, ioutil.Discard)
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("unsupported command server channel 'X'"))
+		})
+
+		It("refuses to change the environment", func() {
+			_, err := server.Run(ctx, "hg", []string{"log"}, []string{"HGUSER=someone"}, "", ioutil.Discard, ioutil.Discard)
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("does not support setting the environment"))
+		})
+
+		It("does not start commands once the context is done", func() {
+			cancelledCtx, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err := server.Run(cancelledCtx, "hg", []string{"log"}, nil, "", ioutil.Discard, ioutil.Discard)
+			Expect(err).To(Equal(context.Canceled))
+			Expect(requests).To(BeEmpty())
+		})
+
+		It("fails once closed", func() {
+			server.Close()
+			_, err := server.Run(ctx, "hg", []string{"log"}, nil, "", ioutil.Discard, ioutil.Discard)
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("command server is not running"))
+		})
+	})
+
+	Context("When talking to hg serve --cmdserver", func() {
+		It("gives the same results and errors as separate hg processes", func() {
+			_, err := exec.LookPath("hg")
+			if err != nil {
+				Skip("hg is not installed")
+			}
+
+			repoDir, err := ioutil.TempDir("", "hg-resource-cmdserver")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(repoDir)
+			runHg(repoDir, "init")
+			Expect(ioutil.WriteFile(path.Join(repoDir, "a_file"), []byte("x"), 0644)).To(Succeed())
+			runHg(repoDir, "commit", "-A", "-m", "init", "--user", "test <test@example.com>")
+
+			server, err := StartCommandServer(nil)
+			Expect(err).To(BeNil())
+			defer server.Close()
+
+			execRepo := &Repository{Path: repoDir, Branch: "default"}
+			serverRepo := &Repository{Path: repoDir, Branch: "default", Runner: server}
+
+			execCommitId, err := execRepo.GetCurrentCommitId(ctx)
+			Expect(err).To(BeNil())
+			serverCommitId, err := serverRepo.GetCurrentCommitId(ctx)
+			Expect(err).To(BeNil())
+			Expect(serverCommitId).To(Equal(execCommitId))
+
+			execErr := execRepo.Checkout(ctx, "bogus")
+			serverErr := serverRepo.Checkout(ctx, "bogus")
+			Expect(serverErr).ToNot(BeNil())
+			Expect(serverErr.Error()).To(Equal(execErr.Error()))
+		})
+
+		It("starts a new server for the command after one that timed out", func() {
+			_, err := exec.LookPath("hg")
+			if err != nil {
+				Skip("hg is not installed")
+			}
+
+			server, err := StartCommandServer(nil)
+			Expect(err).To(BeNil())
+			defer server.Close()
+
+			// like Run does when the context of a command is done
+			Expect(server.stop()).To(Succeed())
+
+			var stdout bytes.Buffer
+			exitCode, err := server.Run(ctx, "hg", []string{"version", "--quiet"}, nil, "", &stdout, ioutil.Discard)
+			Expect(err).To(BeNil())
+			Expect(exitCode).To(Equal(0))
+			Expect(stdout.String()).To(ContainSubstring("Mercurial"))
+		})
+	})
+})
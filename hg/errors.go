@@ -0,0 +1,260 @@
+package hg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// An hg command that exited with a non-zero exit code. Failures that are
+// recognized from the error output of hg are returned as one of the more
+// specific errors below, which all embed a CommandError.
+//
+// The message only gives the exit code, like exec does, as callers print the
+// output of commands themselves. Peers, which talk to the remote without
+// running hg, have no exit code, and set Message instead.
+type CommandError struct {
+	Command  string
+	ExitCode int
+	Stderr   string
+	Message  string
+}
+
+func (self *CommandError) Error() string {
+	if len(self.Message) > 0 {
+		return self.Message
+	}
+	return fmt.Sprintf("exit status %d", self.ExitCode)
+}
+
+// A revision that is not in the repository, or hidden.
+type UnknownRevisionError struct {
+	CommandError
+}
+
+// A push that was refused because it would create a new head on the remote.
+// Pulling and rebasing before pushing again may resolve it.
+type NonFastForwardError struct {
+	CommandError
+}
+
+// The certificate of the remote did not match any of the fingerprints pinned
+// for its host. Unlike the other errors, the message says so, as the output
+// of hg does not make it obvious that the certificate may have been replaced.
+type FingerprintMismatchError struct {
+	CommandError
+	Host        string
+	Fingerprint string
+}
+
+func (self *FingerprintMismatchError) Error() string {
+	return fmt.Sprintf("certificate for %s has unexpected fingerprint %s", self.Host, self.Fingerprint)
+}
+
+var fingerprintMismatchPattern = regexp.MustCompile(`certificate for (\S+) has unexpected fingerprint (\S+)`)
+
+func makeFingerprintMismatchError(commandError CommandError) error {
+	fingerprintMismatchError := &FingerprintMismatchError{CommandError: commandError}
+	match := fingerprintMismatchPattern.FindStringSubmatch(commandError.Stderr)
+	if match != nil {
+		fingerprintMismatchError.Host = match[1]
+		fingerprintMismatchError.Fingerprint = match[2]
+	}
+	return fingerprintMismatchError
+}
+
+// The remote refused the credentials, or required some.
+type AuthenticationError struct {
+	CommandError
+}
+
+// ssh refused to connect because the host key of the remote is not known or
+// does not match the known one, see known_hosts.
+type HostKeyError struct {
+	CommandError
+}
+
+// The TLS connection to the remote failed, e.g. because its certificate
+// could not be verified.
+type TlsError struct {
+	CommandError
+}
+
+// The remote could not be reached, e.g. because its host name did not
+// resolve or the connection was refused or timed out.
+type HostUnreachableError struct {
+	CommandError
+}
+
+// The connection to the remote dropped, or the remote, or a proxy in front
+// of it, failed temporarily, e.g. with HTTP 502.
+type TransientError struct {
+	CommandError
+}
+
+// The repository or working directory is locked by another process.
+type LockHeldError struct {
+	CommandError
+}
+
+// A merge, rebase or update stopped with unresolved conflicts.
+type MergeConflictError struct {
+	CommandError
+}
+
+// A command that was stopped because it took longer than Timeout, or because
+// its context was cancelled, in which case Timeout is 0.
+type TimeoutError struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (self *TimeoutError) Error() string {
+	if self.Timeout > 0 {
+		return fmt.Sprintf("hg %s timed out after %s", self.Command, self.Timeout)
+	}
+	return fmt.Sprintf("hg %s was cancelled", self.Command)
+}
+
+func makeContextError(ctx context.Context, command string, timeout time.Duration) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Command: command, Timeout: timeout}
+	}
+	return &TimeoutError{Command: command}
+}
+
+// Parts of the error output that identify a kind of failure. They are
+// matched against the failure lines of the output in lower case, in this
+// order, so that more specific failures are recognized first.
+var errorPatterns = []struct {
+	substrings []string
+	wrap       func(CommandError) error
+}{
+	{
+		[]string{"abort: unknown revision", "abort: hidden revision", "abort: filtered revision"},
+		func(commandError CommandError) error { return &UnknownRevisionError{commandError} },
+	},
+	{
+		[]string{"abort: push creates new remote head"},
+		func(commandError CommandError) error { return &NonFastForwardError{commandError} },
+	},
+	{
+		[]string{"timed out waiting for lock held by"},
+		func(commandError CommandError) error { return &LockHeldError{commandError} },
+	},
+	{
+		[]string{"unresolved conflicts", "unresolved merge conflicts"},
+		func(commandError CommandError) error { return &MergeConflictError{commandError} },
+	},
+	{
+		[]string{"has unexpected fingerprint"},
+		makeFingerprintMismatchError,
+	},
+	{
+		[]string{"certificate verify failed", "abort: error: [ssl", "abort: certificate for", "x509: ", "tls: "},
+		func(commandError CommandError) error { return &TlsError{commandError} },
+	},
+	{
+		[]string{"host key verification failed"},
+		func(commandError CommandError) error { return &HostKeyError{commandError} },
+	},
+	{
+		[]string{"abort: authorization failed", "abort: http authorization required", "http error 401", "http error 403", "permission denied (publickey"},
+		func(commandError CommandError) error { return &AuthenticationError{commandError} },
+	},
+	{
+		[]string{"http error 502", "http error 503", "http error 504", "connection reset by peer", "broken pipe", "closed by remote host", "stream ended unexpectedly", "remote end closed connection"},
+		func(commandError CommandError) error { return &TransientError{commandError} },
+	},
+	{
+		[]string{"connection refused", "name or service not known", "nodename nor servname", "temporary failure in name resolution", "could not resolve hostname", "network is unreachable", "no route to host", "connection timed out", "operation timed out", "no such host", "abort: no suitable response from remote hg"},
+		func(commandError CommandError) error { return &HostUnreachableError{commandError} },
+	},
+}
+
+// Returns the most specific error for a command that exited with a
+// non-zero exit code.
+func makeCommandError(command string, exitCode int, stderr string) error {
+	return classifyError(CommandError{
+		Command:  command,
+		ExitCode: exitCode,
+		Stderr:   stderr,
+	}, failureLines(stderr))
+}
+
+// Like makeCommandError, for a peer that failed with message, e.g. because
+// ssh printed output to its error output.
+func makePeerError(command string, message string, output string) error {
+	return classifyError(CommandError{
+		Command: command,
+		Stderr:  output,
+		Message: message,
+	}, strings.Split(strings.ToLower(output), "\n"))
+}
+
+// The lines of hg's error output that describe why it failed, in lower
+// case. Other output, e.g. of hooks on the remote side, may mention
+// anything and is left out, except what ssh printed when hg got no
+// response from it.
+func failureLines(stderr string) []string {
+	var lines []string
+	var remoteLines []string
+	noResponse := false
+	for _, line := range strings.Split(strings.ToLower(stderr), "\n") {
+		switch {
+		case strings.HasPrefix(line, "abort: "):
+			lines = append(lines, line)
+			noResponse = noResponse || strings.HasPrefix(line, "abort: no suitable response from remote hg")
+		case strings.HasPrefix(line, "unresolved "):
+			lines = append(lines, line)
+		case strings.HasPrefix(line, "remote: "):
+			remoteLines = append(remoteLines, strings.TrimPrefix(line, "remote: "))
+		}
+	}
+	if noResponse {
+		lines = append(lines, remoteLines...)
+	}
+	return lines
+}
+
+func classifyError(commandError CommandError, lines []string) error {
+	for _, pattern := range errorPatterns {
+		for _, substring := range pattern.substrings {
+			for _, line := range lines {
+				if strings.Contains(line, substring) {
+					return pattern.wrap(commandError)
+				}
+			}
+		}
+	}
+	return &commandError
+}
+
+func isUnknownRevisionError(err error) bool {
+	var unknownRevisionError *UnknownRevisionError
+	return errors.As(err, &unknownRevisionError)
+}
+
+// Whether trying again later may succeed, i.e. whether a command that talks
+// to a remote repository should be retried.
+func IsTransientError(err error) bool {
+	var transientError *TransientError
+	var hostUnreachableError *HostUnreachableError
+	var lockHeldError *LockHeldError
+	var timeoutError *TimeoutError
+	var netError net.Error
+	switch {
+	case errors.As(err, &transientError), errors.As(err, &hostUnreachableError), errors.As(err, &lockHeldError):
+		return true
+	case errors.As(err, &timeoutError):
+		// a cancelled command is not retried
+		return timeoutError.Timeout > 0
+	case errors.As(err, &netError):
+		return true
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package hg
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Errors", func() {
+	Context("When classifying the error output of hg", func() {
+		It("recognizes each kind of failure", func() {
+			var unknownRevisionError *UnknownRevisionError
+			var nonFastForwardError *NonFastForwardError
+			var authenticationError *AuthenticationError
+			var tlsError *TlsError
+			var hostKeyError *HostKeyError
+			var hostUnreachableError *HostUnreachableError
+			var lockHeldError *LockHeldError
+			var mergeConflictError *MergeConflictError
+			var transientError *TransientError
+
+			Expect(errors.As(makeCommandError("log", 255, "abort: unknown revision 'bogus'!\n"), &unknownRevisionError)).To(BeTrue())
+			Expect(errors.As(makeCommandError("push", 255, "pushing to push-target\nsearching for changes\nabort: push creates new remote head 4484191cd2e4!\n"), &nonFastForwardError)).To(BeTrue())
+			Expect(errors.As(makeCommandError("pull", 255, "abort: authorization failed\n"), &authenticationError)).To(BeTrue())
+			Expect(errors.As(makeCommandError("pull", 255, "remote: git@example.com: Permission denied (publickey).\nabort: no suitable response from remote hg!\n"), &authenticationError)).To(BeTrue())
+			Expect(errors.As(makeCommandError("clone", 255, "remote: No ED25519 host key is known for hg.example.com and you have requested strict checking.\nremote: Host key verification failed.\nabort: no suitable response from remote hg!\n"), &hostKeyError)).To(BeTrue())
+			Expect(errors.As(makeCommandError("clone", 255, "abort: error: [SSL: CERTIFICATE_VERIFY_FAILED] certificate verify failed (_ssl.c:1056)\n"), &tlsError)).To(BeTrue())
+			Expect(errors.As(makeCommandError("clone", 255, "abort: error: Connection refused\n"), &hostUnreachableError)).To(BeTrue())
+			Expect(errors.As(makeCommandError("pull", 255, "remote: ssh: Could not resolve hostname example.invalid: Name or service not known\nabort: no suitable response from remote hg!\n"), &hostUnreachableError)).To(BeTrue())
+			Expect(errors.As(makeCommandError("pull", 255, "waiting for lock on repository /repo held by process '42' on host 'worker'\nabort: repository /repo: timed out waiting for lock held by 'worker:42'\n"), &lockHeldError)).To(BeTrue())
+			Expect(errors.As(makeCommandError("rebase", 1, "merging a_file\nwarning: conflicts while merging a_file! (edit, then use 'hg resolve --mark')\nunresolved conflicts (see 'hg resolve', then 'hg rebase --continue')\n"), &mergeConflictError)).To(BeTrue())
+			Expect(errors.As(makeCommandError("pull", 255, "abort: HTTP Error 502: Bad Gateway\n"), &transientError)).To(BeTrue())
+			Expect(errors.As(makeCommandError("push", 255, "remote: Connection reset by peer\nabort: stream ended unexpectedly (got 0 bytes, expected 4)\n"), &transientError)).To(BeTrue())
+		})
+
+		It("only looks at why hg failed, not at what remote hooks printed", func() {
+			err := makeCommandError("push", 255, "pushing to ssh://hg.example.com/repo\nremote: adding changesets\nremote: ssl: broken pipe while notifying ci, connection reset by peer\nremote: transaction abort!\nabort: pretxnchangegroup.check hook exited with status 1\n")
+			Expect(err).To(Equal(&CommandError{Command: "push", ExitCode: 255, Stderr: "pushing to ssh://hg.example.com/repo\nremote: adding changesets\nremote: ssl: broken pipe while notifying ci, connection reset by peer\nremote: transaction abort!\nabort: pretxnchangegroup.check hook exited with status 1\n"}))
+			Expect(IsTransientError(err)).To(BeFalse())
+		})
+
+		It("says which certificate did not match the pinned fingerprints", func() {
+			err := makeCommandError("pull", 255, "abort: certificate for hg.example.com has unexpected fingerprint sha256:ab:cd\n(check hostsecurity configuration)\n")
+
+			var fingerprintMismatchError *FingerprintMismatchError
+			Expect(errors.As(err, &fingerprintMismatchError)).To(BeTrue())
+			Expect(fingerprintMismatchError.Host).To(Equal("hg.example.com"))
+			Expect(err.Error()).To(Equal("certificate for hg.example.com has unexpected fingerprint sha256:ab:cd"))
+		})
+
+		It("falls back to a plain CommandError", func() {
+			err := makeCommandError("log", 10, "hg: parse error: unknown identifier: foo\n")
+			Expect(err).To(Equal(&CommandError{Command: "log", ExitCode: 10, Stderr: "hg: parse error: unknown identifier: foo\n"}))
+		})
+
+		It("carries the exit code and error output through wrapping", func() {
+			err := fmt.Errorf("Error pushing to somewhere: %w", makeCommandError("push", 1, "abort: push creates new remote head 4484191cd2e4!\n"))
+			Expect(err.Error()).To(Equal("Error pushing to somewhere: exit status 1"))
+
+			var nonFastForwardError *NonFastForwardError
+			Expect(errors.As(err, &nonFastForwardError)).To(BeTrue())
+			Expect(nonFastForwardError.ExitCode).To(Equal(1))
+			Expect(nonFastForwardError.Stderr).To(ContainSubstring("new remote head"))
+		})
+	})
+
+	Context("When deciding whether to retry", func() {
+		It("retries failures that may go away", func() {
+			Expect(IsTransientError(makeCommandError("pull", 255, "abort: HTTP Error 503: Service Unavailable\n"))).To(BeTrue())
+			Expect(IsTransientError(makeCommandError("clone", 255, "abort: error: Connection refused\n"))).To(BeTrue())
+			Expect(IsTransientError(fmt.Errorf("Error pulling: %w", &TimeoutError{Command: "pull", Timeout: time.Minute}))).To(BeTrue())
+		})
+
+		It("does not retry other failures", func() {
+			Expect(IsTransientError(makeCommandError("pull", 255, "abort: authorization failed\n"))).To(BeFalse())
+			Expect(IsTransientError(makeCommandError("push", 1, "abort: push creates new remote head 4484191cd2e4!\n"))).To(BeFalse())
+			Expect(IsTransientError(&TimeoutError{Command: "pull"})).To(BeFalse())
+			Expect(IsTransientError(errors.New("something else"))).To(BeFalse())
+		})
+	})
+})
@@ -1,11 +1,18 @@
 package hg
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
-	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -13,19 +20,88 @@ import (
 type Repository struct {
 	Path                string
 	Branch              string
+	Bookmark            string
+	Branches            []string
 	IncludePaths        []string
 	ExcludePaths        []string
+	Authors             []string
+	IgnoreAuthors       []string
+	Merges              string
 	TagFilter           string
 	RevSetFilter        string
+	InitialRef          string
+	SinceDate           string
+	Phases              []string
+	SkipCiPatterns      []string
+	DisableCiSkip       bool
+	Evolution           bool
 	SkipSslVerification bool
+	// runs hg, defaults to an ExecRunner
+	Runner Runner
+	// bound each command that talks to a remote repository, e.g. clone,
+	// pull and push, and each other command, e.g. revset evaluation by log
+	NetworkTimeout time.Duration
+	Timeout        time.Duration
+	// how often a command that talks to a remote repository is retried
+	// after a transient failure, and the delay before the first retry
+	Retries      int
+	RetryBackoff time.Duration
+	// credentials for an HTTP(S) remote, and a PEM file with the
+	// certificates of the authorities its certificate is verified with,
+	// instead of the ones of the system
+	HttpAuth    *HttpAuth
+	CaCertsFile string
+	// sha256 fingerprints of certificates by host name, e.g.
+	// "sha256:4e:1f:...". The certificate of a host that has fingerprints
+	// must match one of them, and is not verified with the authorities.
+	HostFingerprints map[string][]string
+	// the command line hg runs ssh with, see `hg help config.ui.ssh`,
+	// defaults to ssh
+	SshCommand string
+	// where the output of commands and retries are logged, defaults to
+	// os.Stderr, and whether each line is prefixed with the current time
+	Stderr     io.Writer
+	Timestamps bool
+	// the node InitialRef was resolved to, so that the queries of tracked
+	// commits start at the same commit, see ResolveInitialRef
+	initialNode string
 }
 
+// Returned if a commit is not in the repository (anymore), e.g. because it
+// was stripped, or pruned without successors.
+var ErrCommitNotFound = errors.New("commit not found")
+
+// Commits with a message matching one of these are skipped, unless
+// SkipCiPatterns is set.
+var DefaultSkipCiPatterns = []string{"[ci skip]"}
+
+// How merge changesets are matched against IncludePaths and ExcludePaths.
+const (
+	// merges match if they touch a path relative to any parent (the default)
+	MergesInclude = "include"
+	// merges never match
+	MergesExclude = "exclude"
+	// merges match if they change a path relative to their first parent
+	MergesFirstParent = "first_parent"
+)
+
+var MergeModes = []string{MergesInclude, MergesExclude, MergesFirstParent}
+
+// All phases a changeset can be in, see `hg help phases`.
+var Phases = []string{"public", "draft", "secret"}
+
 type CommitProperty struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
 	Type  string `json:"type,omitempty"`
 }
 
+// A changeset together with the named branch it was committed to.
+type BranchCommit struct {
+	Id     string
+	Branch string
+}
+
 type HgChangeset struct {
 	Rev       int      `json:"rev"`
 	Node      string   `json:"node"`
@@ -39,63 +115,132 @@ type HgChangeset struct {
 	Parents   []string `json:"parents"`
 }
 
-func (self *Repository) CloneOrPull(sourceUri string) ([]byte, error) {
+func (self *Repository) CloneOrPull(ctx context.Context, sourceUri string) error {
 	if len(self.Path) == 0 {
-		return []byte{}, fmt.Errorf("CloneOrPull: repository path must be set")
+		return fmt.Errorf("CloneOrPull: repository path must be set")
 	}
 
-	if len(self.Branch) == 0 {
-		return []byte{}, fmt.Errorf("CloneOrPull: branch must be set")
+	if len(self.Branch) == 0 && len(self.Bookmark) == 0 && len(self.Branches) == 0 {
+		return fmt.Errorf("CloneOrPull: branch, branches or bookmark must be set")
 	}
 
 	dirInfo, errIfNotExists := os.Stat(path.Join(self.Path, ".hg"))
 	if errIfNotExists != nil || !dirInfo.IsDir() {
-		return self.clone(sourceUri)
-	} else {
-		return self.pull()
+		return self.clone(ctx, sourceUri)
 	}
+
+	// the repository may have been cloned from a different uri, in which
+	// case pulling would silently fetch from the wrong place
+	defaultPath, err := self.getDefaultPath(ctx)
+	if err != nil || !isSameUri(defaultPath, sourceUri) {
+		err = self.Delete()
+		if err != nil {
+			return err
+		}
+		return self.clone(ctx, sourceUri)
+	}
+
+	return self.pull(ctx)
 }
 
-func (self *Repository) clone(sourceUri string) (output []byte, err error) {
-	_, output, err = self.run("clone", []string{
-		"-q",
-		"--branch", self.Branch,
+func (self *Repository) getDefaultPath(ctx context.Context) (defaultPath string, err error) {
+	outBytes, err := self.query(ctx, "config", []string{
+		"--cwd", self.Path,
+		"paths.default",
+	})
+	if err != nil {
+		err = fmt.Errorf("Error getting default path of repository: %w", err)
+		return
+	}
+
+	defaultPath = strings.TrimSpace(string(outBytes))
+	return
+}
+
+// Compares two repository locations, tolerating the differences Mercurial
+// introduces when it records the source of a clone in paths.default.
+func isSameUri(a string, b string) bool {
+	return NormalizeUri(a) == NormalizeUri(b)
+}
+
+// Returns the form of a repository location that isSameUri compares, e.g.
+// an absolute path for file:///repo/ and /repo. Passwords are dropped, as hg
+// does not record them in paths.default.
+func NormalizeUri(uri string) string {
+	normalized := strings.TrimPrefix(strings.TrimRight(uri, "/"), "file://")
+	if !strings.Contains(normalized, "://") {
+		absPath, err := filepath.Abs(normalized)
+		if err == nil {
+			normalized = absPath
+		}
+		return normalized
+	}
+
+	parsed, err := url.Parse(normalized)
+	if err == nil && parsed.User != nil {
+		parsed.User = url.User(parsed.User.Username())
+		normalized = parsed.String()
+	}
+	return normalized
+}
+
+func (self *Repository) clone(ctx context.Context, sourceUri string) (err error) {
+	// when following several branches, all of them have to be fetched
+	var selector []string
+	if len(self.Bookmark) > 0 {
+		selector = []string{"--rev", self.Bookmark}
+	} else if len(self.Branches) == 0 {
+		selector = []string{"--branch", self.Branch}
+	}
+
+	err = self.runClone(ctx, append(append([]string{"-q"}, selector...),
 		sourceUri,
 		self.Path,
-	})
+	))
 	if err != nil {
-		err = fmt.Errorf("Error cloning repository from %s: %s", sourceUri, err)
+		err = fmt.Errorf("Error cloning repository from %s: %w", RedactUri(sourceUri), err)
 	}
 
 	return
 }
 
-func (self *Repository) pull() (output []byte, err error) {
-	_, output, err = self.run("pull", []string{
+func (self *Repository) pull(ctx context.Context) (err error) {
+	err = self.run(ctx, "pull", []string{
 		"-q",
 		"--cwd", self.Path,
 	})
 	if err != nil {
-		err = fmt.Errorf("Error pulling changes from repository: %s", err)
+		err = fmt.Errorf("Error pulling changes from repository: %w", err)
 		return
 	}
 
-	_, checkoutOutput, err := self.run("checkout", []string{
+	err = self.run(ctx, "checkout", []string{
 		"-q",
 		"--cwd", self.Path,
 		"--clean",
-		"--rev", self.Branch,
+		"--rev", Rev(self.TrackedRev()).String(),
 	})
-	output = append(output, checkoutOutput...)
 	if err != nil {
-		err = fmt.Errorf("Error updating working directory to tip: %s", err)
+		err = fmt.Errorf("Error updating working directory to tip: %w", err)
 	}
 
 	return
 }
 
-func (self *Repository) PullWithRebase(sourceUri string, branch string) (output []byte, err error) {
-	_, output, err = self.run("pull", []string{
+// Returns the name of the bookmark or branch the repository follows, or tip
+// if it follows several branches.
+func (self *Repository) TrackedRev() string {
+	if len(self.Bookmark) > 0 {
+		return self.Bookmark
+	}
+	if len(self.Branches) > 0 {
+		return "tip"
+	}
+	return self.Branch
+}
+
+func (self *Repository) PullWithRebase(ctx context.Context, sourceUri string, branch string) (err error) {
+	err = self.run(ctx, "pull", []string{
 		"-q",
 		"--cwd", self.Path,
 		"--config", "extensions.rebase=",
@@ -105,7 +250,154 @@ func (self *Repository) PullWithRebase(sourceUri string, branch string) (output
 		"push-target",
 	})
 	if err != nil {
-		err = fmt.Errorf("Error pulling/rebasing from: %s: %s", sourceUri, err)
+		err = fmt.Errorf("Error pulling/rebasing from: %s: %w", RedactUri(sourceUri), err)
+	}
+	return
+}
+
+var commitIdPattern = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// Asks sourceUri for the commit the tracked branch or bookmark points to,
+// without cloning or pulling. HTTP(S) and SSH remotes are queried without
+// running hg locally.
+func (self *Repository) GetRemoteHead(ctx context.Context, sourceUri string) (commitId string, err error) {
+	if IsHttpUri(sourceUri) || IsSshUri(sourceUri) {
+		err = self.retry(ctx, "lookup", func(ctx context.Context) error {
+			if self.NetworkTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, self.NetworkTimeout)
+				defer cancel()
+			}
+
+			var err error
+			commitId, err = self.lookupRemoteHead(ctx, sourceUri)
+			if ctx.Err() != nil {
+				err = makeContextError(ctx, "lookup", self.NetworkTimeout)
+			}
+			return err
+		})
+		return
+	}
+
+	// other uris are local repositories, which identify evaluates revsets
+	// in, so that the latest commit on the branch can be found like in a
+	// clone
+	rev := self.TrackedRev()
+	if len(self.Bookmark) == 0 && len(self.Branches) == 0 {
+		rev = Last(Branch("literal:" + self.Branch)).String()
+	}
+
+	// --debug makes identify print full commit ids, along with debug output
+	outBytes, err := self.query(ctx, "identify", []string{
+		"--debug",
+		"--id",
+		"--rev", rev,
+		sourceUri,
+	})
+	if err != nil {
+		err = fmt.Errorf("Error getting head of %s from %s: %w", self.TrackedRev(), RedactUri(sourceUri), err)
+		return
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(outBytes)), "\n")
+	commitId = strings.TrimSpace(lines[len(lines)-1])
+	if !commitIdPattern.MatchString(commitId) {
+		err = fmt.Errorf("Error getting head of %s from %s: unexpected output: %s", self.TrackedRev(), RedactUri(sourceUri), string(outBytes))
+	}
+	return
+}
+
+func (self *Repository) lookupRemoteHead(ctx context.Context, sourceUri string) (string, error) {
+	if IsHttpUri(sourceUri) {
+		peer := HttpPeer{
+			Uri:                 sourceUri,
+			SkipSslVerification: self.SkipSslVerification,
+			CaCertsFile:         self.CaCertsFile,
+			HostFingerprints:    self.HostFingerprints,
+		}
+		if self.HttpAuth != nil {
+			peer.Username = self.HttpAuth.Username
+			peer.Password = self.HttpAuth.Password
+			peer.ClientCertFile = self.HttpAuth.CertFile
+			peer.ClientKeyFile = self.HttpAuth.KeyFile
+		}
+		if len(self.Bookmark) > 0 || len(self.Branches) > 0 {
+			return peer.Lookup(ctx, self.TrackedRev())
+		}
+		branchMap, err := peer.BranchMap(ctx)
+		if err != nil {
+			return "", err
+		}
+		return self.lastBranchHead(branchMap, sourceUri)
+	}
+
+	peer := SshPeer{Uri: sourceUri, SshCommand: self.SshCommand}
+	err := peer.Connect(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer peer.Close()
+	if len(self.Bookmark) > 0 || len(self.Branches) > 0 {
+		return peer.Lookup(self.TrackedRev())
+	}
+	branchMap, err := peer.BranchMap()
+	if err != nil {
+		return "", err
+	}
+	return self.lastBranchHead(branchMap, sourceUri)
+}
+
+// Returns the head of Branch with the highest revision number, which is the
+// latest commit on the branch, like GetLatestCommitId finds it in a clone.
+// Looking up the branch name would skip closed heads instead. The heads of
+// each branch are listed in the order of their revision numbers.
+func (self *Repository) lastBranchHead(branchMap map[string][]string, sourceUri string) (string, error) {
+	heads := branchMap[self.Branch]
+	if len(heads) == 0 {
+		return "", fmt.Errorf("Error getting head of %s from %s: branch not found", self.Branch, RedactUri(sourceUri))
+	}
+	return heads[len(heads)-1], nil
+}
+
+// Pulls the given bookmark from sourceUri and rebases the working directory
+// onto it. Unlike PullWithRebase, the rebase destination is the bookmark and
+// not the branch head, which is ambiguous if several bookmarks share a branch.
+func (self *Repository) PullBookmarkWithRebase(ctx context.Context, sourceUri string, bookmark string) (err error) {
+	err = self.run(ctx, "pull", []string{
+		"-q",
+		"--cwd", self.Path,
+		"--config", "paths.push-target=" + sourceUri,
+		"--bookmark", bookmark,
+		"push-target",
+	})
+	if err != nil {
+		err = fmt.Errorf("Error pulling bookmark %s from: %s: %w", bookmark, RedactUri(sourceUri), err)
+		return
+	}
+
+	// nothing to rebase if the bookmark is an ancestor of the working directory
+	bookmarkRevSet := Bookmark("literal:" + bookmark)
+	outBytes, err := self.query(ctx, "log", []string{
+		"--cwd", self.Path,
+		"--rev", Difference(bookmarkRevSet, Ancestors(Rev("."))).String(),
+		"--template", "{node}",
+	})
+	if err != nil {
+		err = fmt.Errorf("Error looking up bookmark %s: %w", bookmark, err)
+		return
+	}
+	if len(strings.TrimSpace(string(outBytes))) == 0 {
+		return
+	}
+
+	err = self.run(ctx, "rebase", []string{
+		"--cwd", self.Path,
+		"--config", "extensions.rebase=",
+		"--base", ".",
+		"--dest", bookmarkRevSet.String(),
+	})
+	if err != nil {
+		err = fmt.Errorf("Error rebasing onto bookmark %s: %w", bookmark, err)
 	}
 	return
 }
@@ -113,56 +405,83 @@ func (self *Repository) PullWithRebase(sourceUri string, branch string) (output
 // Clones sourceUri into the repository and truncates all history after the given commit,
 // making it the new tip. After truncating, we can add a tag commit at tip, and then push
 // the whole known branch (... -> given commit -> tag commit == tip) to another repository.
-func (self *Repository) CloneAtCommit(sourceUri string, commitId string) (output []byte, err error) {
-	_, output, err = self.run("clone", []string{
+func (self *Repository) CloneAtCommit(ctx context.Context, sourceUri string, commitId string) (err error) {
+	err = self.runClone(ctx, []string{
 		"-q",
 		"--rev", commitId,
 		sourceUri,
 		self.Path,
 	})
 	if err != nil {
-		err = fmt.Errorf("Error cloning repository %s@%s: %s", sourceUri, commitId, err)
+		err = fmt.Errorf("Error cloning repository %s@%s: %w", RedactUri(sourceUri), commitId, err)
 	}
 
 	return
 }
 
 // Makes the repository rebaseable. See `hg help phases`.
-func (self *Repository) SetDraftPhase() (output []byte, err error) {
-	_, output, err = self.run("phase", []string{
+func (self *Repository) SetDraftPhase(ctx context.Context) (err error) {
+	err = self.run(ctx, "phase", []string{
 		"--cwd", self.Path,
 		"--force",
 		"--draft",
 	})
 	if err != nil {
-		err = fmt.Errorf("Error setting repo phase to draft: %s", err)
+		err = fmt.Errorf("Error setting repo phase to draft: %w", err)
 	}
 
 	return
 }
 
-func (self *Repository) Push(destUri string, branch string) (output []byte, err error) {
-	_, output, err = self.run("push", []string{
+func (self *Repository) Push(ctx context.Context, destUri string, branch string) (err error) {
+	err = self.runPush(ctx, []string{
 		"--cwd", self.Path,
 		"--config", "paths.push-target=" + destUri,
 		"--branch", branch,
 		"push-target",
 	})
 	if err != nil {
-		err = fmt.Errorf("Error pushing to %s: %s", destUri, err)
+		err = fmt.Errorf("Error pushing to %s: %w", RedactUri(destUri), err)
+	}
+
+	return
+}
+
+// Moves the bookmark to the working directory parent and pushes it, along
+// with the changesets it points to.
+func (self *Repository) PushBookmark(ctx context.Context, destUri string, bookmark string) (err error) {
+	err = self.run(ctx, "bookmark", []string{
+		"--cwd", self.Path,
+		"--force",
+		"--rev", ".",
+		bookmark,
+	})
+	if err != nil {
+		err = fmt.Errorf("Error moving bookmark %s: %w", bookmark, err)
+		return
+	}
+
+	err = self.runPush(ctx, []string{
+		"--cwd", self.Path,
+		"--config", "paths.push-target=" + destUri,
+		"--bookmark", bookmark,
+		"push-target",
+	})
+	if err != nil {
+		err = fmt.Errorf("Error pushing bookmark %s to %s: %w", bookmark, RedactUri(destUri), err)
 	}
 
 	return
 }
 
 // Tags a commit. Expects to be run only at tip!
-func (self *Repository) Tag(tagValue string) (output []byte, err error) {
-	_, output, err = self.run("tag", []string{
+func (self *Repository) Tag(ctx context.Context, tagValue string) (err error) {
+	err = self.run(ctx, "tag", []string{
 		"--cwd", self.Path,
 		tagValue,
 	})
 	if err != nil {
-		err = fmt.Errorf("Error tagging current commit: %s", err)
+		err = fmt.Errorf("Error tagging current commit: %w", err)
 	}
 
 	return
@@ -171,90 +490,114 @@ func (self *Repository) Tag(tagValue string) (output []byte, err error) {
 func (self *Repository) Delete() error {
 	err := os.RemoveAll(self.Path)
 	if err != nil {
-		return fmt.Errorf("Error deleting repository: %s", err)
+		return fmt.Errorf("Error deleting repository: %w", err)
 	}
 
 	return nil
 }
 
-func (self *Repository) Checkout(commitId string) (output []byte, err error) {
-	_, output, err = self.run("checkout", []string{
-		"-q",
-		"--cwd", self.Path,
+func (self *Repository) Checkout(ctx context.Context, commitId string) (err error) {
+	// a version may have become obsolete since it was emitted
+	args := append([]string{"-q", "--cwd", self.Path}, self.hiddenArgs()...)
+	err = self.run(ctx, "checkout", append(args,
 		"--clean",
-		"--rev", commitId,
-	})
+		"--rev", Rev(commitId).String(),
+	))
 	if err != nil {
-		err = fmt.Errorf("Error checking out %s: %s", commitId, err)
+		err = fmt.Errorf("Error checking out %s: %w", commitId, err)
 	}
 
 	return
 }
 
-func (self *Repository) Purge() (output []byte, err error) {
-	_, output, err = self.run("purge", []string{
+func (self *Repository) Purge(ctx context.Context) (err error) {
+	err = self.run(ctx, "purge", []string{
 		"--config", "extensions.purge=",
 		"--cwd", self.Path,
 		"--all",
 	})
 	if err != nil {
-		err = fmt.Errorf("Error purging repository: %s", err)
+		err = fmt.Errorf("Error purging repository: %w", err)
 	}
 
 	return
 }
 
-func (self *Repository) GetLatestCommitId() (output string, err error) {
-	branch := escapePath(self.Branch)
-	include := self.makeIncludeQueryFragment()
-	exclude := self.makeExcludeQueryFragment()
-	revSetFilter := self.maybeRevSetFilter()
-	revSet := fmt.Sprintf("last((((%s) - (%s)) & branch('%s') & %s) - desc('[ci skip]'))", include, exclude, branch, revSetFilter)
-
-	_, outBytes, err := self.run("log", []string{
+func (self *Repository) GetLatestCommitId(ctx context.Context) (output string, err error) {
+	outBytes, err := self.query(ctx, "log", []string{
 		"--cwd", self.Path,
-		"--rev", revSet,
+		"--rev", Last(self.makeTrackedQuery()).String(),
 		"--template", "{node}",
 	})
 	output = string(outBytes)
 	if err != nil {
-		err = fmt.Errorf("Error getting latest commit id: %s", err)
+		err = fmt.Errorf("Error getting latest commit id: %w", err)
 	}
 
 	return
 }
 
-func (self *Repository) GetCurrentCommitId() (output string, err error) {
-	_, outBytes, err := self.run("log", []string{
+// Resolves InitialRef, e.g. a tag or bookmark, to the node of its commit
+// once, and bounds the queries of tracked commits by that node. Returns
+// ErrCommitNotFound if InitialRef is set but not in the repository, which
+// the queries would only report as an unknown revision.
+func (self *Repository) ResolveInitialRef(ctx context.Context) error {
+	if len(self.InitialRef) == 0 {
+		return nil
+	}
+
+	outBytes, err := self.query(ctx, "log", []string{
+		"--cwd", self.Path,
+		"--rev", Rev(self.InitialRef).String(),
+		"--template", "{node}",
+	})
+	if isUnknownRevisionError(err) {
+		return ErrCommitNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("Error resolving initial ref %s: %w", self.InitialRef, err)
+	}
+	self.initialNode = strings.TrimSpace(string(outBytes))
+	return nil
+}
+
+func (self *Repository) GetCurrentCommitId(ctx context.Context) (output string, err error) {
+	outBytes, err := self.query(ctx, "log", []string{
 		"--cwd", self.Path,
 		"--rev", ".",
 		"--template", "{node}",
 	})
 	output = string(outBytes)
 	if err != nil {
-		err = fmt.Errorf("Error getting current commit id: %s", err)
+		err = fmt.Errorf("Error getting current commit id: %w", err)
 	}
 
 	return
 }
 
-func (self *Repository) GetDescendantsOf(commitId string) ([]string, error) {
-	branch := escapePath(self.Branch)
-	include := self.makeIncludeQueryFragment()
-	exclude := self.makeExcludeQueryFragment()
-	revSetFilter := self.maybeRevSetFilter()
-	revSet := fmt.Sprintf("(descendants(%s) - %s) & branch('%s') & %s & ((%s) - (%s)) - desc('[ci skip]')",
-		commitId, commitId, branch, revSetFilter, include, exclude)
+// Returns the tracked commits following commitId. If commitId was rewritten,
+// its successors take its place and are returned as well. Returns
+// ErrCommitNotFound if commitId is unknown.
+func (self *Repository) GetDescendantsOf(ctx context.Context, commitId string) ([]string, error) {
+	successors, err := self.resolveSuccessors(ctx, commitId)
+	if err != nil {
+		return []string{}, err
+	}
+	revSet := Intersection(Difference(Descendants(successors), Rev(commitId)), self.makeTrackedQuery())
 
-	_, outBytes, err := self.run("log", []string{
-		"--cwd", self.Path,
-		"--rev", revSet,
+	// commitId itself may be hidden if it is obsolete
+	args := append([]string{"--cwd", self.Path}, self.hiddenArgs()...)
+	outBytes, err := self.query(ctx, "log", append(args,
+		"--rev", revSet.String(),
 		"--template", "{node}\n",
-	})
+	))
 
 	output := string(outBytes)
+	if isUnknownRevisionError(err) {
+		return []string{}, ErrCommitNotFound
+	}
 	if err != nil {
-		return []string{}, fmt.Errorf("Error getting descendant commits of %s: %s\n%s", commitId, err, output)
+		return []string{}, fmt.Errorf("Error getting descendant commits of %s: %w", commitId, err)
 	}
 
 	trimmed := strings.Trim(output, "\n\r ")
@@ -266,30 +609,221 @@ func (self *Repository) GetDescendantsOf(commitId string) ([]string, error) {
 	return commits, nil
 }
 
-func (self *Repository) maybeRevSetFilter() string {
-	var filters []string
+// Returns whether the tracked commits are bounded by an initial ref or date,
+// in which case all of them are of interest, not only the latest.
+func (self *Repository) IsBounded() bool {
+	return len(self.InitialRef) > 0 || len(self.SinceDate) > 0
+}
+
+// Returns all tracked commits, in revision order.
+func (self *Repository) GetAllCommits(ctx context.Context) ([]BranchCommit, error) {
+	commits, err := self.logBranchCommits(ctx, self.makeTrackedQuery())
+	if err != nil {
+		return []BranchCommit{}, fmt.Errorf("Error getting commits: %w", err)
+	}
+	return commits, nil
+}
+
+// Returns the latest tracked commit of every matching branch, in revision
+// order.
+func (self *Repository) GetLatestCommitPerBranch(ctx context.Context) ([]BranchCommit, error) {
+	outBytes, err := self.query(ctx, "log", []string{
+		"--cwd", self.Path,
+		"--rev", Intersection(Call("head"), self.makeBranchQueryFragment()).String(),
+		"--template", "{branch}\n",
+	})
+	if err != nil {
+		return []BranchCommit{}, fmt.Errorf("Error getting matching branches: %w", err)
+	}
+
+	var latestPerBranch []RevSet
+	seen := map[string]bool{}
+	for _, branch := range strings.Split(string(outBytes), "\n") {
+		if len(branch) == 0 || seen[branch] {
+			continue
+		}
+		seen[branch] = true
+		latestPerBranch = append(latestPerBranch,
+			Last(Intersection(self.makeTrackedQuery(), Branch("literal:"+branch))))
+	}
+	if len(latestPerBranch) == 0 {
+		return []BranchCommit{}, nil
+	}
+
+	commits, err := self.logBranchCommits(ctx, Union(latestPerBranch...))
+	if err != nil {
+		return []BranchCommit{}, fmt.Errorf("Error getting latest commits of branches: %w", err)
+	}
+	return commits, nil
+}
+
+// Returns the tracked commits on any matching branch that were added to the
+// repository after commitId. Unlike GetDescendantsOf, this includes commits
+// on branches that do not descend from commitId.
+// Successors of a rewritten commitId are always added after it, and are
+// therefore included. Returns ErrCommitNotFound if commitId is unknown.
+func (self *Repository) GetCommitsSince(ctx context.Context, commitId string) ([]BranchCommit, error) {
+	_, err := self.resolveSuccessors(ctx, commitId)
+	if err != nil {
+		return []BranchCommit{}, err
+	}
+	revSet := Intersection(Difference(RangeFrom(Rev(commitId)), Rev(commitId)), self.makeTrackedQuery())
+
+	commits, err := self.logBranchCommits(ctx, revSet)
+	if err == ErrCommitNotFound {
+		return []BranchCommit{}, err
+	}
+	if err != nil {
+		return []BranchCommit{}, fmt.Errorf("Error getting commits since %s: %w", commitId, err)
+	}
+	return commits, nil
+}
+
+// Returns a revset of the commits that took the place of commitId. Without
+// evolution, or if commitId was not rewritten, that is commitId itself.
+func (self *Repository) resolveSuccessors(ctx context.Context, commitId string) (RevSet, error) {
+	if !self.Evolution {
+		return Rev(commitId), nil
+	}
+
+	revSet := Difference(Successors(Rev(commitId)), Call("obsolete"))
+	outBytes, err := self.query(ctx, "log", []string{
+		"--cwd", self.Path,
+		"--hidden",
+		"--rev", revSet.String(),
+		"--template", "{node}\n",
+	})
+
+	output := string(outBytes)
+	if isUnknownRevisionError(err) {
+		return nil, ErrCommitNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error getting successors of %s: %w", commitId, err)
+	}
+
+	// pruned commits have no successors to continue from
+	if len(strings.TrimSpace(output)) == 0 {
+		return nil, ErrCommitNotFound
+	}
+
+	return revSet, nil
+}
+
+func (self *Repository) logBranchCommits(ctx context.Context, revSet RevSet) ([]BranchCommit, error) {
+	args := append([]string{"--cwd", self.Path}, self.hiddenArgs()...)
+	outBytes, err := self.query(ctx, "log", append(args,
+		"--rev", revSet.String(),
+		"--template", "{node} {branch}\n",
+	))
+	if isUnknownRevisionError(err) {
+		return []BranchCommit{}, ErrCommitNotFound
+	}
+	if err != nil {
+		return []BranchCommit{}, err
+	}
+
+	return parseBranchCommits(string(outBytes)), nil
+}
+
+// Hidden commits are only visible to sources that opted into evolution,
+// whose queries exclude obsolete commits themselves.
+func (self *Repository) hiddenArgs() []string {
+	if !self.Evolution {
+		return nil
+	}
+	return []string{"--hidden"}
+}
+
+func parseBranchCommits(output string) []BranchCommit {
+	commits := []BranchCommit{}
+	for _, line := range strings.Split(output, "\n") {
+		// branch names may contain spaces, commit ids don't
+		idAndBranch := strings.SplitN(strings.TrimRight(line, "\r"), " ", 2)
+		if len(idAndBranch) != 2 {
+			continue
+		}
+		commits = append(commits, BranchCommit{
+			Id:     idAndBranch[0],
+			Branch: idAndBranch[1],
+		})
+	}
+	return commits
+}
+
+func (self *Repository) GetCurrentBranch(ctx context.Context) (output string, err error) {
+	outBytes, err := self.query(ctx, "log", []string{
+		"--cwd", self.Path,
+		"--rev", ".",
+		"--template", "{branch}",
+	})
+	output = string(outBytes)
+	if err != nil {
+		err = fmt.Errorf("Error getting current branch: %w", err)
+	}
+
+	return
+}
+
+// Returns whether any option requires inspecting the history of the
+// repository to find the latest tracked commit, i.e. whether the latest
+// tracked commit may be something other than the head of the branch.
+func (self *Repository) NeedsHistory() bool {
+	return len(self.IncludePaths) > 0 ||
+		len(self.ExcludePaths) > 0 ||
+		len(self.Authors) > 0 ||
+		len(self.IgnoreAuthors) > 0 ||
+		len(self.TagFilter) > 0 ||
+		len(self.RevSetFilter) > 0 ||
+		len(self.Phases) > 0 ||
+		self.Merges == MergesExclude ||
+		self.IsBounded() ||
+		self.Evolution ||
+		!self.DisableCiSkip
+}
+
+// The set of changesets check may emit, before narrowing it down to a
+// range of versions.
+func (self *Repository) makeTrackedQuery() RevSet {
+	revSet := Difference(
+		Intersection(
+			Difference(self.makeIncludeQueryFragment(), self.makeExcludeQueryFragment()),
+			Difference(self.makeAuthorsQueryFragment(), self.makeIgnoredAuthorsQueryFragment()),
+			self.makeBranchQueryFragment(),
+			self.maybeRevSetFilter(),
+			self.makePhaseQueryFragment(),
+			self.makeBoundsQueryFragment(),
+			self.makeMergesQueryFragment(),
+		),
+		self.makeSkipCiQueryFragment(),
+	)
+	if self.Evolution {
+		// queries run with --hidden, so rewritten commits must be excluded here
+		revSet = Difference(revSet, Call("obsolete"))
+	}
+	return revSet
+}
+
+func (self *Repository) maybeRevSetFilter() RevSet {
+	var filters []RevSet
 	if len(self.TagFilter) > 0 {
-		filters = append(filters,
-			"tag('re:"+escapePath(self.TagFilter)+"')")
+		filters = append(filters, Tag("re:"+escapeBackslashes(self.TagFilter)))
 	}
 	if len(self.RevSetFilter) > 0 {
-		filters = append(filters,
-			"("+escapePath(self.RevSetFilter)+")")
+		filters = append(filters, Raw(self.RevSetFilter))
 	}
-	if len(filters) == 0 {
-		return "all()"
-	}
-	return strings.Join(filters, " & ")
+	return Intersection(filters...)
 }
 
-func (self *Repository) Metadata(commitId string) (metadata []CommitProperty, err error) {
-	_, outBytes, err := self.run("log", []string{
+func (self *Repository) Metadata(ctx context.Context, commitId string) (metadata []CommitProperty, err error) {
+	outBytes, err := self.query(ctx, "log", []string{
 		"--cwd", self.Path,
-		"--rev", commitId,
+		"--rev", Rev(commitId).String(),
 		"--template", "json",
 	})
 	if err != nil {
-		err = fmt.Errorf("Error getting metadata for commit %s: %s\n%s", commitId, err, string(outBytes))
+		err = fmt.Errorf("Error getting metadata for commit %s: %w", commitId, err)
+		return
 	}
 
 	metadata, err = parseMetadata(outBytes)
@@ -345,6 +879,10 @@ func (commit *HgChangeset) toCommitProperties() (metadata []CommitProperty, err
 			Name:  "tags",
 			Value: strings.Join(commit.Tags, ", "),
 		},
+		CommitProperty{
+			Name:  "phase",
+			Value: commit.Phase,
+		},
 	)
 
 	return
@@ -366,24 +904,160 @@ func parseMetadata(hgJsonOutput []byte) (metadata []CommitProperty, err error) {
 	return
 }
 
-func (self *Repository) run(command string, args []string) (cmd *exec.Cmd, output []byte, err error) {
+// Runs an hg command, and logs its output and error output as they are
+// written. A non-zero exit code results in a CommandError, or a more
+// specific error. Commands that are stopped by ctx or a timeout result in a
+// TimeoutError. Commands that talk to a remote repository are retried after
+// transient failures, and each attempt gets its own timeout.
+func (self *Repository) run(ctx context.Context, command string, args []string) error {
+	return self.runAttempts(ctx, command, func(ctx context.Context) error {
+		return self.runOnce(ctx, command, args, nil)
+	})
+}
+
+// Like run, for clone into self.Path. A clone that is stopped leaves a
+// partial repository behind, which would fail the next attempt, as the
+// destination is not empty, so it is emptied before each retry.
+func (self *Repository) runClone(ctx context.Context, args []string) error {
+	attempt := 0
+	return self.retry(ctx, "clone", func(ctx context.Context) error {
+		attempt++
+		if attempt > 1 {
+			err := emptyDir(self.Path)
+			if err != nil {
+				return fmt.Errorf("Error removing partial clone: %w", err)
+			}
+		}
+		return self.runOnce(ctx, "clone", args, nil)
+	})
+}
+
+// Like run, for push. A push whose connection dropped may have landed
+// nonetheless, in which case the retry finds no changes, and exits with 1,
+// see `hg help push`. That counts as success.
+func (self *Repository) runPush(ctx context.Context, args []string) error {
+	attempt := 0
+	return self.retry(ctx, "push", func(ctx context.Context) error {
+		attempt++
+		err := self.runOnce(ctx, "push", args, nil)
+		var commandError *CommandError
+		if attempt > 1 && errors.As(err, &commandError) && commandError.ExitCode == 1 {
+			return nil
+		}
+		return err
+	})
+}
+
+// Removes the contents of dir, which may not exist, but keeps dir.
+func emptyDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = os.RemoveAll(path.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Like run, for commands whose output is parsed, e.g. log with a template.
+// The output is returned instead of logged, so that it is never mixed with
+// error output or progress messages.
+func (self *Repository) query(ctx context.Context, command string, args []string) ([]byte, error) {
+	var stdout bytes.Buffer
+	err := self.runAttempts(ctx, command, func(ctx context.Context) error {
+		// only the output of the last attempt counts
+		stdout.Reset()
+		return self.runOnce(ctx, command, args, &stdout)
+	})
+	return stdout.Bytes(), err
+}
+
+func (self *Repository) runAttempts(ctx context.Context, command string, attempt func(ctx context.Context) error) error {
+	if !isNetworkCommand(command) {
+		return attempt(ctx)
+	}
+	return self.retry(ctx, command, attempt)
+}
+
+// Logs stdout if it is nil.
+func (self *Repository) runOnce(ctx context.Context, command string, args []string, stdout io.Writer) error {
 	hgArgs := make([]string, 1, len(args)+1)
 	hgArgs[0] = command
 
-	if self.SkipSslVerification && commandTakesInsecureOption(command) {
+	if self.SkipSslVerification && isNetworkCommand(command) {
 		hgArgs = append(hgArgs, "--insecure")
 	}
+	if isNetworkCommand(command) {
+		hgArgs = append(hgArgs, makeHostFingerprintArgs(self.HostFingerprints)...)
+	}
+	if len(self.SshCommand) > 0 {
+		// not only for network commands, as e.g. checkout clones missing
+		// subrepositories
+		hgArgs = append(hgArgs, "--config", "ui.ssh="+self.SshCommand)
+	}
+	if len(self.CaCertsFile) > 0 && isNetworkCommand(command) {
+		hgArgs = append(hgArgs, "--config", "web.cacerts="+self.CaCertsFile)
+	}
+	if self.HttpAuth != nil && isNetworkCommand(command) {
+		hgArgs = append(hgArgs, self.HttpAuth.configArgs()...)
+	}
+	if self.Evolution {
+		// creates and exchanges obsolescence markers, see `hg help evolution`
+		hgArgs = append(hgArgs, "--config", "experimental.evolution=all")
+	}
 	hgArgs = append(hgArgs, args...)
 
-	cmd = exec.Command("hg", hgArgs...)
+	runner := self.Runner
+	if runner == nil {
+		runner = &ExecRunner{}
+	}
 
-	output, err = cmd.CombinedOutput()
-	return
+	timeout := self.Timeout
+	if isNetworkCommand(command) {
+		timeout = self.NetworkTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	log := newOutputLog(self.stderr(), self.Timestamps)
+	if stdout == nil {
+		stdout = log.stream()
+	}
+	// the end of the error output is kept to recognize the kind of failure
+	stderr := &tailBuffer{limit: maxStderrSize}
+
+	// the password is read from a file, not passed as an argument
+	var env []string
+	if isNetworkCommand(command) {
+		env = self.HttpAuth.Env()
+	}
+
+	exitCode, err := runner.Run(ctx, "hg", hgArgs, env, "", stdout, io.MultiWriter(stderr, log.stream()))
+	if ctx.Err() != nil {
+		return makeContextError(ctx, command, timeout)
+	}
+	if err == nil && exitCode != 0 {
+		return makeCommandError(command, exitCode, stderr.String())
+	}
+	return err
 }
 
-func commandTakesInsecureOption(command string) bool {
+// Commands that talk to a remote repository. These are also the ones that
+// take --insecure.
+func isNetworkCommand(command string) bool {
 	eligibleCommands := []string{
 		"clone",
+		"identify",
 		"pull",
 		"push",
 	}
@@ -395,32 +1069,160 @@ func commandTakesInsecureOption(command string) bool {
 	return false
 }
 
-func (self *Repository) makeIncludeQueryFragment() string {
+// In bookmark mode, the tracked changesets are the ancestors of the
+// bookmark, so that check follows the bookmark as it moves.
+func (self *Repository) makeBranchQueryFragment() RevSet {
+	if len(self.Bookmark) > 0 {
+		return Ancestors(Bookmark("literal:" + self.Bookmark))
+	}
+	if len(self.Branches) > 0 {
+		branches := make([]RevSet, len(self.Branches))
+		for i, branch := range self.Branches {
+			branches[i] = Branch(makeBranchPattern(branch))
+		}
+		return Union(branches...)
+	}
+	return Branch(self.Branch)
+}
+
+// Turns a branch name into a pattern that matches only that branch. Unlike a
+// name, which hg aborts on if no such branch exists, a pattern matches
+// nothing then, so that branches can be listed before they are created.
+// Patterns with the re: prefix are kept.
+func makeBranchPattern(branch string) string {
+	if strings.HasPrefix(branch, "re:") {
+		return branch
+	}
+	return "re:^" + regexp.QuoteMeta(strings.TrimPrefix(branch, "literal:")) + "$"
+}
+
+// Unknown phases are ignored, callers are expected to validate them against
+// Phases.
+func (self *Repository) makePhaseQueryFragment() RevSet {
+	var phases []RevSet
+	for _, phase := range self.Phases {
+		for _, knownPhase := range Phases {
+			if phase == knownPhase {
+				phases = append(phases, Call(phase))
+			}
+		}
+	}
+	if len(phases) == 0 {
+		return All()
+	}
+	return Union(phases...)
+}
+
+// Limits the tracked commits to InitialRef and its descendants, and to
+// commits made after SinceDate.
+func (self *Repository) makeBoundsQueryFragment() RevSet {
+	var bounds []RevSet
+	if len(self.initialNode) > 0 {
+		bounds = append(bounds, Descendants(Rev(self.initialNode)))
+	} else if len(self.InitialRef) > 0 {
+		bounds = append(bounds, Descendants(Rev(self.InitialRef)))
+	}
+	if len(self.SinceDate) > 0 {
+		bounds = append(bounds, Date(">"+self.SinceDate))
+	}
+	return Intersection(bounds...)
+}
+
+func (self *Repository) makeSkipCiQueryFragment() RevSet {
+	if self.DisableCiSkip {
+		return None()
+	}
+
+	patterns := self.SkipCiPatterns
+	if len(patterns) == 0 {
+		patterns = DefaultSkipCiPatterns
+	}
+	descs := make([]RevSet, len(patterns))
+	for i, pattern := range patterns {
+		descs[i] = Desc(pattern)
+	}
+	return Union(descs...)
+}
+
+func (self *Repository) makeMergesQueryFragment() RevSet {
+	if self.Merges == MergesExclude {
+		return Complement(Call("merge"))
+	}
+	return All()
+}
+
+func (self *Repository) makeIncludeQueryFragment() RevSet {
 	if len(self.IncludePaths) == 0 {
-		return "all()"
+		return All()
 	} else {
-		return unionOfPaths(self.IncludePaths)
+		return self.makePathsQueryFragment(self.IncludePaths)
 	}
 }
 
-func (self *Repository) makeExcludeQueryFragment() string {
+func (self *Repository) makeExcludeQueryFragment() RevSet {
 	if len(self.ExcludePaths) == 0 {
-		return "not all()"
+		return None()
 	} else {
-		return unionOfPaths(self.ExcludePaths)
+		return self.makePathsQueryFragment(self.ExcludePaths)
 	}
 }
 
-func unionOfPaths(paths []string) string {
-	escapedPaths := make([]string, len(paths))
+func (self *Repository) makePathsQueryFragment(paths []string) RevSet {
+	escaped := make([]string, len(paths))
 	for i, path := range paths {
-		escapedPaths[i] = "file('re:" + escapePath(path) + "')"
+		escaped[i] = escapeBackslashes(path)
+	}
+	paths = escaped
+	if self.Merges != MergesFirstParent {
+		return unionOfPaths(paths)
+	}
+
+	// file() matches the files a merge touched relative to either parent,
+	// whereas adds(), modifies() and removes() compare to the first parent
+	firstParentChanges := Union(
+		unionOfRegexps(Adds, paths),
+		unionOfRegexps(Modifies, paths),
+		unionOfRegexps(Removes, paths),
+	)
+	return Union(
+		Difference(unionOfPaths(paths), Call("merge")),
+		Intersection(Call("merge"), firstParentChanges),
+	)
+}
+
+func (self *Repository) makeAuthorsQueryFragment() RevSet {
+	if len(self.Authors) == 0 {
+		return All()
+	} else {
+		return unionOfRegexps(User, self.Authors)
 	}
-	return strings.Join(escapedPaths, "|")
 }
 
-func escapePath(path string) string {
-	backslashesEscaped := strings.Replace(path, "\\", "\\\\\\\\", -1)
-	quotesEscaped := strings.Replace(backslashesEscaped, "'", "\\'", -1)
-	return quotesEscaped
+func (self *Repository) makeIgnoredAuthorsQueryFragment() RevSet {
+	if len(self.IgnoreAuthors) == 0 {
+		return None()
+	} else {
+		return unionOfRegexps(User, self.IgnoreAuthors)
+	}
+}
+
+func unionOfPaths(paths []string) RevSet {
+	return unionOfRegexps(File, paths)
+}
+
+// Backslashes in paths and tag_filter match a literal backslash, as they
+// always have, instead of escaping the next character of the regular
+// expression.
+func escapeBackslashes(regexp string) string {
+	return strings.Replace(regexp, `\`, `\\`, -1)
+}
+
+// Matches any of the regular expressions using the given revset predicate,
+// e.g. File or User.
+func unionOfRegexps(predicate func(string) RevSet, regexps []string) RevSet {
+	matches := make([]RevSet, len(regexps))
+	for i, regexp := range regexps {
+		matches[i] = predicate("re:" + regexp)
+	}
+	return Union(matches...)
 }
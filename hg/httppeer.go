@@ -0,0 +1,305 @@
+package hg
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	hgMediaType     = "application/mercurial-0.1"
+	hgUserAgent     = "mercurial/proto-1.0 (hg-resource)"
+	maxResponseSize = 64 * 1024 * 1024
+)
+
+// A client for the commands of the Mercurial wire protocol that query a
+// remote repository over HTTP(S), without running hg. See
+// `hg help internals.wireprotocol`.
+type HttpPeer struct {
+	Uri                 string
+	SkipSslVerification bool
+	// if set, sent instead of the credentials in Uri
+	Username string
+	Password string
+	// PEM files, see Repository.CaCertsFile and HttpAuth
+	CaCertsFile    string
+	ClientCertFile string
+	ClientKeyFile  string
+	// see Repository.HostFingerprints
+	HostFingerprints map[string][]string
+}
+
+func IsHttpUri(uri string) bool {
+	return strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://")
+}
+
+func (self *HttpPeer) Capabilities(ctx context.Context) ([]string, error) {
+	response, err := self.call(ctx, "capabilities", nil)
+	if err != nil {
+		return []string{}, err
+	}
+
+	return strings.Fields(response), nil
+}
+
+// Returns the heads of each named branch, by branch name.
+func (self *HttpPeer) BranchMap(ctx context.Context) (map[string][]string, error) {
+	response, err := self.call(ctx, "branchmap", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBranchMap(response)
+}
+
+func (self *HttpPeer) Heads(ctx context.Context) ([]string, error) {
+	response, err := self.call(ctx, "heads", nil)
+	if err != nil {
+		return []string{}, err
+	}
+
+	return strings.Fields(response), nil
+}
+
+// Returns for each of the given commit ids whether the remote has it.
+func (self *HttpPeer) Known(ctx context.Context, commitIds []string) ([]bool, error) {
+	if len(commitIds) == 0 {
+		return []bool{}, nil
+	}
+
+	response, err := self.call(ctx, "known", url.Values{
+		"nodes": {strings.Join(commitIds, " ")},
+	})
+	if err != nil {
+		return []bool{}, err
+	}
+
+	return parseKnown(response, len(commitIds))
+}
+
+// Resolves a revision identifier, e.g. a branch or bookmark name, to a
+// commit id.
+func (self *HttpPeer) Lookup(ctx context.Context, key string) (string, error) {
+	response, err := self.call(ctx, "lookup", url.Values{
+		"key": {key},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return parseLookup(key, response)
+}
+
+// Returns the keys of a pushkey namespace, e.g. bookmarks or phases.
+func (self *HttpPeer) ListKeys(ctx context.Context, namespace string) (map[string]string, error) {
+	response, err := self.call(ctx, "listkeys", url.Values{
+		"namespace": {namespace},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseListKeys(response), nil
+}
+
+func (self *HttpPeer) call(ctx context.Context, command string, args url.Values) (string, error) {
+	requestUrl, err := url.Parse(self.Uri)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing repository uri: %s", err)
+	}
+
+	// credentials are sent as basic auth, never as part of the url
+	user := requestUrl.User
+	requestUrl.User = nil
+
+	query := url.Values{}
+	for name, values := range args {
+		query[name] = values
+	}
+	query.Set("cmd", command)
+	requestUrl.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, "GET", requestUrl.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("Error creating %s request: %s", command, err)
+	}
+	request.Header.Set("Accept", hgMediaType)
+	request.Header.Set("User-Agent", hgUserAgent)
+	if len(self.Username) > 0 {
+		request.SetBasicAuth(self.Username, self.Password)
+	} else if user != nil {
+		password, _ := user.Password()
+		request.SetBasicAuth(user.Username(), password)
+	}
+
+	client, err := self.httpClient(command)
+	if err != nil {
+		return "", err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		var fingerprintMismatchError *FingerprintMismatchError
+		if ctx.Err() != nil || errors.As(err, &fingerprintMismatchError) {
+			return "", fmt.Errorf("Error running %s on %s: %w", command, requestUrl.Host, err)
+		}
+		return "", makeRequestError(command, fmt.Sprintf("Error running %s on %s: %s", command, requestUrl.Host, err), err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxResponseSize))
+	if err != nil {
+		return "", fmt.Errorf("Error reading %s response from %s: %s", command, requestUrl.Host, err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		// worded like hg, so that the status is classified like for hg
+		return "", makePeerError(command,
+			fmt.Sprintf("Error running %s on %s: HTTP %s\n%s", command, requestUrl.Host, response.Status, string(body)),
+			fmt.Sprintf("abort: HTTP Error %d: %s", response.StatusCode, http.StatusText(response.StatusCode)))
+	}
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), hgMediaType) {
+		return "", fmt.Errorf("Error running %s on %s: not a Mercurial repository", command, requestUrl.Host)
+	}
+
+	return string(body), nil
+}
+
+// The command is only used to report fingerprint mismatches.
+func (self *HttpPeer) httpClient(command string) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: self.SkipSslVerification,
+	}
+
+	if len(self.CaCertsFile) > 0 {
+		caCerts, err := ioutil.ReadFile(self.CaCertsFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA certificates: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCerts) {
+			return nil, fmt.Errorf("Error reading CA certificates: no certificate found in %s", self.CaCertsFile)
+		}
+	}
+
+	if len(self.ClientCertFile) > 0 {
+		clientCert, err := tls.LoadX509KeyPair(self.ClientCertFile, self.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	requestUrl, err := url.Parse(self.Uri)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing repository uri: %s", err)
+	}
+	host := requestUrl.Hostname()
+	fingerprints := self.HostFingerprints[host]
+	if len(fingerprints) > 0 && !self.SkipSslVerification {
+		// the fingerprint replaces the verification with the authorities
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyFingerprint(command, host, state.PeerCertificates[0].Raw, fingerprints)
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// Returns the error of a request that got no response, classified like the
+// error output of hg. Failures that are not recognized count as an
+// unreachable host.
+func makeRequestError(command string, message string, err error) error {
+	peerError := makePeerError(command, message, err.Error())
+	commandError, ok := peerError.(*CommandError)
+	if ok {
+		return &HostUnreachableError{*commandError}
+	}
+	return peerError
+}
+
+func verifyFingerprint(command string, host string, certificate []byte, fingerprints []string) error {
+	fingerprint := formatFingerprint(certificate)
+	for _, expected := range fingerprints {
+		if normalizeFingerprint(expected) == normalizeFingerprint(fingerprint) {
+			return nil
+		}
+	}
+	return &FingerprintMismatchError{
+		CommandError: CommandError{Command: command},
+		Host:         host,
+		Fingerprint:  fingerprint,
+	}
+}
+
+func parseBranchMap(response string) (map[string][]string, error) {
+	branchMap := map[string][]string{}
+	for _, line := range strings.Split(response, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// branch names are url-quoted, as they may contain spaces
+		branch, err := url.PathUnescape(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing branchmap: %s", err)
+		}
+		branchMap[branch] = fields[1:]
+	}
+	return branchMap, nil
+}
+
+func parseKnown(response string, count int) ([]bool, error) {
+	flags := strings.TrimSpace(response)
+	if len(flags) != count {
+		return []bool{}, fmt.Errorf("Error parsing known response: expected %d flags, got '%s'", count, flags)
+	}
+
+	known := make([]bool, count)
+	for i, flag := range flags {
+		switch flag {
+		case '0':
+			known[i] = false
+		case '1':
+			known[i] = true
+		default:
+			return []bool{}, fmt.Errorf("Error parsing known response: unexpected flag '%c'", flag)
+		}
+	}
+	return known, nil
+}
+
+func parseLookup(key string, response string) (string, error) {
+	// "1 <commit id>" on success, "0 <error message>" otherwise
+	successAndResult := strings.SplitN(strings.TrimSpace(response), " ", 2)
+	if len(successAndResult) != 2 {
+		return "", fmt.Errorf("Error looking up %s: unexpected response '%s'", key, response)
+	}
+	if successAndResult[0] != "1" {
+		return "", fmt.Errorf("Error looking up %s: %s", key, successAndResult[1])
+	}
+	return successAndResult[1], nil
+}
+
+func parseListKeys(response string) map[string]string {
+	keys := map[string]string{}
+	for _, line := range strings.Split(response, "\n") {
+		keyAndValue := strings.SplitN(line, "\t", 2)
+		if len(keyAndValue) == 2 {
+			keys[keyAndValue[0]] = keyAndValue[1]
+		}
+	}
+	return keys
+}
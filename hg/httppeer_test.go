@@ -0,0 +1,385 @@
+package hg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	someCommitId  = "f47d10f40bf7a96c2d853c6c6025ba35b6a9c499"
+	otherCommitId = "4484191cd2e41c174ecc2604af06aeb2a21c247f"
+)
+
+var _ = Describe("HttpPeer", func() {
+	Context("When talking to a fake hgweb", func() {
+		var server *httptest.Server
+		var requests []*http.Request
+		var peer *HttpPeer
+
+		BeforeEach(func() {
+			requests = []*http.Request{}
+			server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				requests = append(requests, request)
+				query := request.URL.Query()
+
+				writer.Header().Set("Content-Type", hgMediaType)
+				switch query.Get("cmd") {
+				case "capabilities":
+					fmt.Fprint(writer, "lookup branchmap pushkey known getbundle unbundlehash")
+				case "branchmap":
+					fmt.Fprintf(writer, "default %s\nsome%%20branch %s %s\n", someCommitId, someCommitId, otherCommitId)
+				case "heads":
+					fmt.Fprintf(writer, "%s %s\n", someCommitId, otherCommitId)
+				case "known":
+					fmt.Fprint(writer, "10")
+				case "lookup":
+					if query.Get("key") == "default" {
+						fmt.Fprintf(writer, "1 %s\n", someCommitId)
+					} else {
+						fmt.Fprintf(writer, "0 unknown revision '%s'\n", query.Get("key"))
+					}
+				case "listkeys":
+					fmt.Fprintf(writer, "feature\t%s\nother\t%s", someCommitId, otherCommitId)
+				default:
+					writer.WriteHeader(http.StatusBadRequest)
+				}
+			}))
+
+			peer = &HttpPeer{Uri: server.URL + "/repo"}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("lists capabilities", func() {
+			capabilities, err := peer.Capabilities(ctx)
+			Expect(err).To(BeNil())
+			Expect(capabilities).To(ContainElement("branchmap"))
+			Expect(requests[0].URL.Path).To(Equal("/repo"))
+		})
+
+		It("parses the branchmap", func() {
+			branchMap, err := peer.BranchMap(ctx)
+			Expect(err).To(BeNil())
+			Expect(branchMap).To(Equal(map[string][]string{
+				"default":     {someCommitId},
+				"some branch": {someCommitId, otherCommitId},
+			}))
+		})
+
+		It("finds the latest head of a branch like a clone, including closed heads", func() {
+			repo := &Repository{Branch: "some branch"}
+			commitId, err := repo.GetRemoteHead(ctx, server.URL+"/repo")
+			Expect(err).To(BeNil())
+			Expect(commitId).To(Equal(otherCommitId))
+
+			repo.Branch = "missing"
+			_, err = repo.GetRemoteHead(ctx, server.URL+"/repo")
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("branch not found"))
+		})
+
+		It("lists heads", func() {
+			heads, err := peer.Heads(ctx)
+			Expect(err).To(BeNil())
+			Expect(heads).To(Equal([]string{someCommitId, otherCommitId}))
+		})
+
+		It("asks which commits are known", func() {
+			known, err := peer.Known(ctx, []string{someCommitId, otherCommitId})
+			Expect(err).To(BeNil())
+			Expect(known).To(Equal([]bool{true, false}))
+			Expect(requests[0].URL.Query().Get("nodes")).To(Equal(someCommitId + " " + otherCommitId))
+		})
+
+		It("looks up revisions", func() {
+			commitId, err := peer.Lookup(ctx, "default")
+			Expect(err).To(BeNil())
+			Expect(commitId).To(Equal(someCommitId))
+		})
+
+		It("reports failed lookups", func() {
+			_, err := peer.Lookup(ctx, "bogus")
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("unknown revision 'bogus'"))
+		})
+
+		It("lists keys of a namespace", func() {
+			bookmarks, err := peer.ListKeys(ctx, "bookmarks")
+			Expect(err).To(BeNil())
+			Expect(bookmarks).To(Equal(map[string]string{
+				"feature": someCommitId,
+				"other":   otherCommitId,
+			}))
+			Expect(requests[0].URL.Query().Get("namespace")).To(Equal("bookmarks"))
+		})
+
+		It("sends credentials from the uri as basic auth", func() {
+			peer.Uri = strings.Replace(server.URL, "http://", "http://jdoe:secret@", 1)
+			_, err := peer.Capabilities(ctx)
+			Expect(err).To(BeNil())
+
+			user, password, ok := requests[0].BasicAuth()
+			Expect(ok).To(BeTrue())
+			Expect(user).To(Equal("jdoe"))
+			Expect(password).To(Equal("secret"))
+		})
+
+		It("prefers configured credentials", func() {
+			peer.Uri = strings.Replace(server.URL, "http://", "http://jdoe:secret@", 1)
+			peer.Username = "ci"
+			peer.Password = "a-token"
+			_, err := peer.Capabilities(ctx)
+			Expect(err).To(BeNil())
+
+			user, password, ok := requests[0].BasicAuth()
+			Expect(ok).To(BeTrue())
+			Expect(user).To(Equal("ci"))
+			Expect(password).To(Equal("a-token"))
+		})
+	})
+
+	Context("When talking to something other than a Mercurial repository", func() {
+		It("fails", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				writer.Header().Set("Content-Type", "text/html")
+				fmt.Fprint(writer, "<html></html>")
+			}))
+			defer server.Close()
+
+			peer := &HttpPeer{Uri: server.URL}
+			_, err := peer.Capabilities(ctx)
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("not a Mercurial repository"))
+		})
+	})
+
+	Context("When the server fails", func() {
+		It("returns typed errors, so that transient failures are retried", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				http.Error(writer, "try again later", http.StatusBadGateway)
+			}))
+			defer server.Close()
+
+			peer := &HttpPeer{Uri: server.URL}
+			_, err := peer.Capabilities(ctx)
+			var transientError *TransientError
+			Expect(errors.As(err, &transientError)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("HTTP 502 Bad Gateway"))
+			Expect(IsTransientError(err)).To(BeTrue())
+
+			peer = &HttpPeer{Uri: "http://127.0.0.1:" + getFreePort()}
+			_, err = peer.Capabilities(ctx)
+			var hostUnreachableError *HostUnreachableError
+			Expect(errors.As(err, &hostUnreachableError)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("connection refused"))
+		})
+
+		It("recognizes refused credentials", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				http.Error(writer, "no", http.StatusUnauthorized)
+			}))
+			defer server.Close()
+
+			peer := &HttpPeer{Uri: server.URL}
+			_, err := peer.Capabilities(ctx)
+			var authenticationError *AuthenticationError
+			Expect(errors.As(err, &authenticationError)).To(BeTrue())
+			Expect(IsTransientError(err)).To(BeFalse())
+		})
+	})
+
+	Context("When talking to a server with a private CA that requires client certificates", func() {
+		var server *httptest.Server
+		var dir string
+
+		BeforeEach(func() {
+			server = httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				if len(request.TLS.PeerCertificates) == 0 {
+					writer.WriteHeader(http.StatusForbidden)
+					return
+				}
+				writer.Header().Set("Content-Type", hgMediaType)
+				fmt.Fprint(writer, "lookup branchmap")
+			}))
+			server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+			server.StartTLS()
+
+			var err error
+			dir, err = ioutil.TempDir("", "hg-resource-httppeer-tls")
+			Expect(err).To(BeNil())
+			caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+			Expect(ioutil.WriteFile(path.Join(dir, "ca.pem"), caCert, 0600)).To(Succeed())
+			clientCert, clientKey := makeTestCertificate()
+			Expect(ioutil.WriteFile(path.Join(dir, "cert.pem"), clientCert, 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(path.Join(dir, "key.pem"), clientKey, 0600)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.RemoveAll(dir)
+		})
+
+		It("verifies the server with the CA, and presents the client certificate", func() {
+			peer := &HttpPeer{
+				Uri:            server.URL,
+				CaCertsFile:    path.Join(dir, "ca.pem"),
+				ClientCertFile: path.Join(dir, "cert.pem"),
+				ClientKeyFile:  path.Join(dir, "key.pem"),
+			}
+			capabilities, err := peer.Capabilities(ctx)
+			Expect(err).To(BeNil())
+			Expect(capabilities).To(Equal([]string{"lookup", "branchmap"}))
+		})
+
+		It("accepts a pinned fingerprint instead of the CA", func() {
+			peer := &HttpPeer{
+				Uri:              server.URL,
+				ClientCertFile:   path.Join(dir, "cert.pem"),
+				ClientKeyFile:    path.Join(dir, "key.pem"),
+				HostFingerprints: map[string][]string{"127.0.0.1": {"sha256:00", strings.ToUpper(formatFingerprint(server.Certificate().Raw))}},
+			}
+			_, err := peer.Capabilities(ctx)
+			Expect(err).To(BeNil())
+		})
+
+		It("fails if the fingerprint does not match", func() {
+			peer := &HttpPeer{
+				Uri:              server.URL,
+				CaCertsFile:      path.Join(dir, "ca.pem"),
+				HostFingerprints: map[string][]string{"127.0.0.1": {"sha256:00"}},
+			}
+			_, err := peer.Capabilities(ctx)
+			var fingerprintMismatchError *FingerprintMismatchError
+			Expect(errors.As(err, &fingerprintMismatchError)).To(BeTrue())
+			Expect(fingerprintMismatchError.Command).To(Equal("capabilities"))
+			Expect(fingerprintMismatchError.Host).To(Equal("127.0.0.1"))
+			Expect(fingerprintMismatchError.Fingerprint).To(Equal(formatFingerprint(server.Certificate().Raw)))
+		})
+
+		It("fails without the CA", func() {
+			peer := &HttpPeer{Uri: server.URL}
+			_, err := peer.Capabilities(ctx)
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("certificate"))
+		})
+	})
+
+	Context("When talking to hg serve", func() {
+		var repoDir string
+		var serve *exec.Cmd
+		var peer *HttpPeer
+		var tipId string
+
+		BeforeEach(func() {
+			_, err := exec.LookPath("hg")
+			if err != nil {
+				Skip("hg is not installed")
+			}
+
+			repoDir, err = ioutil.TempDir("", "hg-resource-httppeer")
+			Expect(err).To(BeNil())
+			runHg(repoDir, "init")
+			Expect(ioutil.WriteFile(path.Join(repoDir, "a_file"), []byte("x"), 0644)).To(Succeed())
+			runHg(repoDir, "commit", "-A", "-m", "init", "--user", "test <test@example.com>")
+			runHg(repoDir, "bookmark", "feature")
+			tipId = runHg(repoDir, "log", "--rev", "tip", "--template", "{node}")
+
+			port := getFreePort()
+			serve = exec.Command("hg", "serve", "--cwd", repoDir, "--address", "127.0.0.1", "--port", port)
+			Expect(serve.Start()).To(Succeed())
+			peer = &HttpPeer{Uri: "http://127.0.0.1:" + port + "/"}
+			Eventually(func() error {
+				_, err := peer.Capabilities(ctx)
+				return err
+			}, 10*time.Second).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			if serve != nil && serve.Process != nil {
+				serve.Process.Kill()
+				serve.Wait()
+			}
+			os.RemoveAll(repoDir)
+		})
+
+		It("looks up branches and bookmarks", func() {
+			commitId, err := peer.Lookup(ctx, "default")
+			Expect(err).To(BeNil())
+			Expect(commitId).To(Equal(tipId))
+
+			bookmarks, err := peer.ListKeys(ctx, "bookmarks")
+			Expect(err).To(BeNil())
+			Expect(bookmarks).To(HaveKeyWithValue("feature", tipId))
+		})
+
+		It("returns the branchmap and heads", func() {
+			branchMap, err := peer.BranchMap(ctx)
+			Expect(err).To(BeNil())
+			Expect(branchMap).To(HaveKeyWithValue("default", []string{tipId}))
+
+			heads, err := peer.Heads(ctx)
+			Expect(err).To(BeNil())
+			Expect(heads).To(Equal([]string{tipId}))
+
+			known, err := peer.Known(ctx, []string{tipId, otherCommitId})
+			Expect(err).To(BeNil())
+			Expect(known).To(Equal([]bool{true, false}))
+		})
+	})
+})
+
+func runHg(repoDir string, args ...string) string {
+	output, err := exec.Command("hg", append([]string{"--cwd", repoDir}, args...)...).CombinedOutput()
+	Expect(err).To(BeNil(), string(output))
+	return string(output)
+}
+
+func getFreePort() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+	defer listener.Close()
+	return fmt.Sprint(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Returns a self-signed certificate and its key, PEM encoded.
+func makeTestCertificate() (certPem []byte, keyPem []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hg-resource"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+
+	certPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return
+}
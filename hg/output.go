@@ -0,0 +1,95 @@
+package hg
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// How much of the end of the error output of a command is kept to recognize
+// the kind of failure. Commands print the reason they failed last.
+const maxStderrSize = 64 * 1024
+
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+func (self *Repository) stderr() io.Writer {
+	if self.Stderr == nil {
+		return os.Stderr
+	}
+	return self.Stderr
+}
+
+// Logs the output of a command as it is written. The output and error
+// output are written concurrently, so each of them gets its own stream, and
+// the streams take turns writing to the log.
+type outputLog struct {
+	mutex      sync.Mutex
+	out        io.Writer
+	timestamps bool
+	now        func() time.Time
+}
+
+func newOutputLog(out io.Writer, timestamps bool) *outputLog {
+	return &outputLog{out: out, timestamps: timestamps, now: time.Now}
+}
+
+func (self *outputLog) stream() io.Writer {
+	return &outputStream{log: self, atLineStart: true}
+}
+
+type outputStream struct {
+	log         *outputLog
+	atLineStart bool
+}
+
+// Prefixes each line with the time its first part was written, if
+// timestamps are enabled.
+func (self *outputStream) Write(data []byte) (int, error) {
+	self.log.mutex.Lock()
+	defer self.log.mutex.Unlock()
+
+	if !self.log.timestamps {
+		return self.log.out.Write(data)
+	}
+
+	for rest := data; len(rest) > 0; {
+		line := rest
+		if end := bytes.IndexByte(rest, '\n'); end >= 0 {
+			line = rest[:end+1]
+		}
+		rest = rest[len(line):]
+
+		if self.atLineStart {
+			_, err := io.WriteString(self.log.out, self.log.now().Format(timestampLayout)+" ")
+			if err != nil {
+				return 0, err
+			}
+		}
+		_, err := self.log.out.Write(line)
+		if err != nil {
+			return 0, err
+		}
+		self.atLineStart = line[len(line)-1] == '\n'
+	}
+	return len(data), nil
+}
+
+// Keeps the last limit bytes written to it.
+type tailBuffer struct {
+	limit int
+	data  []byte
+}
+
+func (self *tailBuffer) Write(data []byte) (int, error) {
+	self.data = append(self.data, data...)
+	if len(self.data) > self.limit {
+		self.data = append([]byte{}, self.data[len(self.data)-self.limit:]...)
+	}
+	return len(data), nil
+}
+
+func (self *tailBuffer) String() string {
+	return string(self.data)
+}
@@ -0,0 +1,62 @@
+package hg
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Output", func() {
+	Context("When logging the output of a command", func() {
+		var out *bytes.Buffer
+
+		BeforeEach(func() {
+			out = &bytes.Buffer{}
+		})
+
+		It("passes output through unchanged without timestamps", func() {
+			stream := newOutputLog(out, false).stream()
+			stream.Write([]byte("adding changesets\nadding man"))
+			stream.Write([]byte("ifests\n"))
+			Expect(out.String()).To(Equal("adding changesets\nadding manifests\n"))
+		})
+
+		It("prefixes each line with the time it started", func() {
+			log := newOutputLog(out, true)
+			now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			log.now = func() time.Time { return now }
+
+			stream := log.stream()
+			stream.Write([]byte("adding changesets\nadding man"))
+			now = now.Add(time.Second)
+			stream.Write([]byte("ifests\n\n"))
+			Expect(out.String()).To(Equal(
+				"2026-01-02T03:04:05.000Z adding changesets\n" +
+					"2026-01-02T03:04:05.000Z adding manifests\n" +
+					"2026-01-02T03:04:06.000Z \n"))
+		})
+
+		It("tracks the start of lines for each stream", func() {
+			log := newOutputLog(out, true)
+			log.now = func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+			stdout := log.stream()
+			stderr := log.stream()
+			stdout.Write([]byte("pulling"))
+			stderr.Write([]byte("warning\n"))
+			Expect(out.String()).To(Equal("2026-01-02T03:04:05.000Z pulling2026-01-02T03:04:05.000Z warning\n"))
+		})
+	})
+
+	Context("When keeping the end of the error output", func() {
+		It("drops all but the last bytes", func() {
+			buffer := &tailBuffer{limit: 10}
+			buffer.Write([]byte(strings.Repeat("x", 20)))
+			buffer.Write([]byte("abort: y\n"))
+			Expect(buffer.String()).To(Equal("xabort: y\n"))
+		})
+	})
+})
@@ -0,0 +1,54 @@
+package hg
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// The delay before the first retry if RetryBackoff is not set.
+const defaultRetryBackoff = time.Second
+
+// Runs attempt until it succeeds, fails with an error that is not
+// transient, or Retries retries failed. The delay between attempts doubles
+// after each retry, and is randomized, so that resources that failed
+// together do not retry together. Each failed attempt is logged.
+func (self *Repository) retry(ctx context.Context, command string, attempt func(ctx context.Context) error) error {
+	attempts := self.Retries + 1
+	for i := 1; ; i++ {
+		err := attempt(ctx)
+		if err == nil || !IsTransientError(err) || self.Retries <= 0 {
+			return err
+		}
+
+		stderr := self.stderr()
+		if i == attempts {
+			fmt.Fprintf(stderr, "hg %s failed on attempt %d/%d: %s, giving up\n", command, i, attempts, err)
+			return err
+		}
+
+		delay := retryDelay(self.RetryBackoff, i)
+		fmt.Fprintf(stderr, "hg %s failed on attempt %d/%d: %s, retrying in %s\n", command, i, attempts, err, delay.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Returns a random delay between half of and the full exponential backoff
+// for the given retry, counting from 1.
+func retryDelay(backoff time.Duration, retry int) time.Duration {
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+
+	// doubling stops at an hour, long before the delay could overflow
+	delay := backoff
+	for i := 1; i < retry && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,25 @@
+package hg
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retry", func() {
+	Context("When computing the delay before a retry", func() {
+		It("doubles the backoff with each retry, and skips a random part of it", func() {
+			for retry, maxDelay := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 4: 80 * time.Second} {
+				delay := retryDelay(10*time.Second, retry)
+				Expect(delay).To(BeNumerically(">=", maxDelay/2))
+				Expect(delay).To(BeNumerically("<=", maxDelay))
+			}
+		})
+
+		It("defaults to a second, and stops doubling", func() {
+			Expect(retryDelay(0, 1)).To(BeNumerically("<=", time.Second))
+			Expect(retryDelay(time.Minute, 1000)).To(BeNumerically("<=", 2*time.Hour))
+		})
+	})
+})
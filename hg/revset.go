@@ -0,0 +1,219 @@
+package hg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A revset expression, see `hg help revsets`. Expressions are built from the
+// functions in this file instead of by formatting strings, so that values
+// are always quoted, and operands are always grouped as intended.
+type RevSet interface {
+	String() string
+}
+
+// A function call, e.g. branch('default') or merge().
+type revSetCall struct {
+	name string
+	args []RevSet
+}
+
+func (self revSetCall) String() string {
+	args := make([]string, len(self.args))
+	for i, arg := range self.args {
+		args[i] = arg.String()
+	}
+	return self.name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// A quoted string. Depending on where it is used, it is a revision
+// identifier, or a pattern like 're:^release/'.
+type revSetString string
+
+func (self revSetString) String() string {
+	return quoteRevSetString(string(self))
+}
+
+// An infix operator applied to two or more operands.
+type revSetOperation struct {
+	operator string
+	operands []RevSet
+}
+
+func (self revSetOperation) String() string {
+	operands := make([]string, len(self.operands))
+	for i, operand := range self.operands {
+		operands[i] = operand.String()
+	}
+	return "(" + strings.Join(operands, " "+self.operator+" ") + ")"
+}
+
+type revSetComplement struct {
+	operand RevSet
+}
+
+func (self revSetComplement) String() string {
+	return "(not " + self.operand.String() + ")"
+}
+
+// A range of revisions from a revision up to tip, in revision number order.
+type revSetRangeFrom struct {
+	start RevSet
+}
+
+func (self revSetRangeFrom) String() string {
+	return "(" + self.start.String() + ":)"
+}
+
+// A revset fragment written by a user, e.g. the revset_filter of a source.
+// It is inserted verbatim, and only grouped, as it is expected to be a
+// revset on its own.
+type revSetRaw string
+
+func (self revSetRaw) String() string {
+	return "(" + string(self) + ")"
+}
+
+// Quotes a string, so that the revset parser reads it back unchanged.
+// Besides quotes and backslashes, control characters are escaped, as they
+// would be unreadable in error messages.
+func quoteRevSetString(value string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('\'')
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\' || c == '\'':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&quoted, "\\x%02x", c)
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('\'')
+	return quoted.String()
+}
+
+// Calls a revset predicate or function, e.g. Call("merge").
+func Call(name string, args ...RevSet) RevSet {
+	return revSetCall{name: name, args: args}
+}
+
+// A revision identifier, e.g. a commit id, bookmark or tag name, or ".".
+func Rev(identifier string) RevSet {
+	return revSetString(identifier)
+}
+
+// A fragment that is already a revset, e.g. one configured by a user.
+func Raw(fragment string) RevSet {
+	return revSetRaw(fragment)
+}
+
+func All() RevSet {
+	return Call("all")
+}
+
+func None() RevSet {
+	return Call("none")
+}
+
+// The following take patterns in the string matching syntax of Mercurial,
+// see `hg help revisions.patterns`, e.g. "re:^release/".
+
+func Branch(pattern string) RevSet {
+	return Call("branch", revSetString(pattern))
+}
+
+func Bookmark(pattern string) RevSet {
+	return Call("bookmark", revSetString(pattern))
+}
+
+func Tag(pattern string) RevSet {
+	return Call("tag", revSetString(pattern))
+}
+
+func User(pattern string) RevSet {
+	return Call("user", revSetString(pattern))
+}
+
+func Desc(pattern string) RevSet {
+	return Call("desc", revSetString(pattern))
+}
+
+// The following take file patterns, see `hg help patterns`, e.g. "re:^src/".
+
+func File(pattern string) RevSet {
+	return Call("file", revSetString(pattern))
+}
+
+func Adds(pattern string) RevSet {
+	return Call("adds", revSetString(pattern))
+}
+
+func Modifies(pattern string) RevSet {
+	return Call("modifies", revSetString(pattern))
+}
+
+func Removes(pattern string) RevSet {
+	return Call("removes", revSetString(pattern))
+}
+
+// Takes a date range, see `hg help dates`, e.g. ">2017-01-01".
+func Date(dateRange string) RevSet {
+	return Call("date", revSetString(dateRange))
+}
+
+func Descendants(set RevSet) RevSet {
+	return Call("descendants", set)
+}
+
+func Ancestors(set RevSet) RevSet {
+	return Call("ancestors", set)
+}
+
+func Successors(set RevSet) RevSet {
+	return Call("successors", set)
+}
+
+func Last(set RevSet) RevSet {
+	return Call("last", set)
+}
+
+// The revisions from start up to tip, including revisions that are not
+// descendants of start.
+func RangeFrom(start RevSet) RevSet {
+	return revSetRangeFrom{start: start}
+}
+
+// Returns None for no sets.
+func Union(sets ...RevSet) RevSet {
+	switch len(sets) {
+	case 0:
+		return None()
+	case 1:
+		return sets[0]
+	}
+	return revSetOperation{operator: "|", operands: sets}
+}
+
+// Returns All for no sets.
+func Intersection(sets ...RevSet) RevSet {
+	switch len(sets) {
+	case 0:
+		return All()
+	case 1:
+		return sets[0]
+	}
+	return revSetOperation{operator: "&", operands: sets}
+}
+
+func Difference(set RevSet, excluded RevSet) RevSet {
+	return revSetOperation{operator: "-", operands: []RevSet{set, excluded}}
+}
+
+// All revisions that are not in set, i.e. `not set`.
+func Complement(set RevSet) RevSet {
+	return revSetComplement{operand: set}
+}
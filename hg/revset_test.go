@@ -0,0 +1,192 @@
+package hg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RevSet", func() {
+	Context("When quoting strings", func() {
+		It("escapes quotes and backslashes", func() {
+			Expect(Desc(`it's a \ bot`).String()).To(Equal(`desc('it\'s a \\ bot')`))
+		})
+
+		It("escapes control characters", func() {
+			Expect(Desc("line\nbreak\x00").String()).To(Equal(`desc('line\x0abreak\x00')`))
+		})
+
+		It("leaves regular expressions intact", func() {
+			Expect(User(`re:@example\.com>$`).String()).To(Equal(`user('re:@example\\.com>$')`))
+		})
+
+		It("quotes revision identifiers", func() {
+			Expect(Descendants(Rev("x') | all() | ('")).String()).To(Equal(`descendants('x\') | all() | (\'')`))
+		})
+	})
+
+	Context("When combining sets", func() {
+		It("groups every operation", func() {
+			revSet := Difference(
+				Intersection(Branch("default"), Union(File("re:^a/"), File("re:^b/"))),
+				Complement(Call("merge")),
+			)
+			Expect(revSet.String()).To(Equal("((branch('default') & (file('re:^a/') | file('re:^b/'))) - (not merge()))"))
+		})
+
+		It("simplifies empty and single operands", func() {
+			Expect(Union().String()).To(Equal("none()"))
+			Expect(Intersection().String()).To(Equal("all()"))
+			Expect(Union(Tag("re:^v")).String()).To(Equal("tag('re:^v')"))
+		})
+
+		It("groups raw fragments", func() {
+			Expect(Intersection(Raw("author(jane) or keyword(bug)"), Call("head")).String()).To(Equal(
+				"((author(jane) or keyword(bug)) & head())"))
+		})
+
+		It("builds ranges and date bounds", func() {
+			Expect(Difference(RangeFrom(Rev(someCommitId)), Rev(someCommitId)).String()).To(Equal(
+				fmt.Sprintf("(('%s':) - '%s')", someCommitId, someCommitId)))
+			Expect(Date(">2026-01-01").String()).To(Equal("date('>2026-01-01')"))
+		})
+	})
+
+	Context("When reading quoted strings back", func() {
+		It("recovers the original value", func() {
+			for _, value := range []string{"", `\`, `'`, `\'`, "re:^a\\.b$", "\x00\xff", "é"} {
+				parsed, rest, err := parseRevSetString(quoteRevSetString(value))
+				Expect(err).To(BeNil())
+				Expect(rest).To(BeEmpty())
+				Expect(parsed).To(Equal(value))
+			}
+		})
+	})
+
+	Context("When hg evaluates quoted strings", func() {
+		var repoDir string
+
+		BeforeEach(func() {
+			_, err := exec.LookPath("hg")
+			if err != nil {
+				Skip("hg is not installed")
+			}
+
+			repoDir, err = ioutil.TempDir("", "hg-resource-revset")
+			Expect(err).To(BeNil())
+			runHg(repoDir, "init")
+			Expect(ioutil.WriteFile(path.Join(repoDir, "a_file"), []byte("x"), 0644)).To(Succeed())
+			runHg(repoDir, "commit", "-A", "-m", "init", "--user", "test <test@example.com>")
+			Expect(ioutil.WriteFile(path.Join(repoDir, "a_file"), []byte("y"), 0644)).To(Succeed())
+			runHg(repoDir, "commit", "-m", `it's a \ bot`, "--user", "test <test@example.com>")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(repoDir)
+		})
+
+		It("matches values that try to end the string early against nothing", func() {
+			for _, value := range []string{"') | all() | ('", `\'`, `\x27`} {
+				for _, revSet := range []RevSet{Desc(value), User(value)} {
+					output := runHg(repoDir, "log", "--rev", revSet.String(), "--template", "{rev}\n")
+					Expect(output).To(BeEmpty(), revSet.String())
+				}
+			}
+		})
+
+		It("matches values with quotes and backslashes exactly", func() {
+			output := runHg(repoDir, "log", "--rev", Desc(`it's a \ bot`).String(), "--template", "{rev}\n")
+			Expect(output).To(Equal("1\n"))
+		})
+	})
+})
+
+// Checks that no value can end the string it is quoted in early, i.e. that
+// the parser of Mercurial reads back exactly the value, followed by the
+// rest of the expression.
+func FuzzQuoteRevSetString(f *testing.F) {
+	for _, seed := range []string{"default", "re:^release/", "') | all() | ('", `\`, `\'`, "\n", "\\x27"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		expression := Union(User("re:"+value), All()).String()
+		if !strings.HasPrefix(expression, "(user(") {
+			t.Fatalf("unexpected expression %q", expression)
+		}
+
+		parsed, rest, err := parseRevSetString(strings.TrimPrefix(expression, "(user("))
+		if err != nil {
+			t.Fatalf("%s in %q", err, expression)
+		}
+		if parsed != "re:"+value {
+			t.Fatalf("read back %q instead of %q from %q", parsed, "re:"+value, expression)
+		}
+		if rest != ") | all())" {
+			t.Fatalf("unexpected rest %q of %q", rest, expression)
+		}
+	})
+}
+
+// Reads a quoted string from the start of a revset expression like the
+// tokenizer of Mercurial: a backslash skips the following character, and
+// the string is then unescaped like a Python string literal.
+func parseRevSetString(expression string) (value string, rest string, err error) {
+	if len(expression) == 0 || expression[0] != '\'' {
+		return "", "", fmt.Errorf("expected a quote at the start of %q", expression)
+	}
+
+	for pos := 1; pos < len(expression); pos++ {
+		switch expression[pos] {
+		case '\\':
+			pos++
+		case '\'':
+			value, err = unescapePythonString(expression[1:pos])
+			return value, expression[pos+1:], err
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string %q", expression)
+}
+
+func unescapePythonString(escaped string) (string, error) {
+	var value strings.Builder
+	for pos := 0; pos < len(escaped); pos++ {
+		if escaped[pos] != '\\' || pos+1 == len(escaped) {
+			value.WriteByte(escaped[pos])
+			continue
+		}
+
+		pos++
+		switch escaped[pos] {
+		case '\\', '\'', '"':
+			value.WriteByte(escaped[pos])
+		case 'n':
+			value.WriteByte('\n')
+		case 't':
+			value.WriteByte('\t')
+		case 'x':
+			if pos+3 > len(escaped) {
+				return "", fmt.Errorf("truncated \\x escape in %q", escaped)
+			}
+			code, err := strconv.ParseUint(escaped[pos+1:pos+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid \\x escape in %q", escaped)
+			}
+			value.WriteByte(byte(code))
+			pos += 2
+		default:
+			// unknown escapes are kept as they are
+			value.WriteByte('\\')
+			value.WriteByte(escaped[pos])
+		}
+	}
+	return value.String(), nil
+}
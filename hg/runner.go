@@ -0,0 +1,120 @@
+package hg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Runs the commands of a Repository, and writes their output and error
+// output to stdout and stderr as it is produced. err is only set if the
+// command could not be run at all; a command that fails reports a non-zero
+// exit code. Commands are stopped when ctx is done.
+type Runner interface {
+	Run(ctx context.Context, command string, args []string, env []string, dir string, stdout io.Writer, stderr io.Writer) (exitCode int, err error)
+}
+
+// Runs each command as a new process. This is the default Runner.
+type ExecRunner struct {
+	// if set, run instead of the command, e.g. chg or a specific hg binary
+	Path string
+}
+
+// env is added to the environment of the resource, and dir defaults to its
+// working directory.
+func (self *ExecRunner) Run(ctx context.Context, command string, args []string, env []string, dir string, stdout io.Writer, stderr io.Writer) (exitCode int, err error) {
+	if len(self.Path) > 0 {
+		command = self.Path
+	}
+
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// ssh started by hg may keep the output open after hg was stopped
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		err = nil
+		exitCode = exitErr.ExitCode()
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			err = fmt.Errorf("%s was killed by %s", command, status.Signal())
+		}
+	}
+	return exitCode, err
+}
+
+// A command a Runner was asked to run.
+type RunnerCall struct {
+	Command string
+	Args    []string
+	Env     []string
+	Dir     string
+}
+
+// The outcome of a RunnerCall.
+type RunnerResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Err      error
+}
+
+// A Runner for tests that records the calls it gets, and replays Results in
+// order instead of running anything. If Delegate is set, the calls are run
+// by it and their results are recorded instead, so that they can be
+// replayed later.
+type FakeRunner struct {
+	Delegate Runner
+	Calls    []RunnerCall
+	Results  []RunnerResult
+}
+
+func (self *FakeRunner) Run(ctx context.Context, command string, args []string, env []string, dir string, stdout io.Writer, stderr io.Writer) (exitCode int, err error) {
+	self.Calls = append(self.Calls, RunnerCall{
+		Command: command,
+		Args:    append([]string{}, args...),
+		Env:     append([]string{}, env...),
+		Dir:     dir,
+	})
+
+	if self.Delegate != nil {
+		var stdoutBuffer, stderrBuffer bytes.Buffer
+		exitCode, err = self.Delegate.Run(ctx, command, args, env, dir,
+			io.MultiWriter(&stdoutBuffer, stdout), io.MultiWriter(&stderrBuffer, stderr))
+		self.Results = append(self.Results, RunnerResult{
+			Stdout:   stdoutBuffer.String(),
+			Stderr:   stderrBuffer.String(),
+			ExitCode: exitCode,
+			Err:      err,
+		})
+		return
+	}
+
+	if len(self.Calls) > len(self.Results) {
+		return 0, fmt.Errorf("FakeRunner: no result for call %d: %s %v", len(self.Calls), command, args)
+	}
+	result := self.Results[len(self.Calls)-1]
+	io.WriteString(stdout, result.Stdout)
+	io.WriteString(stderr, result.Stderr)
+	return result.ExitCode, result.Err
+}
+
+// Returns the arguments of the calls so far, e.g. to check the revsets of
+// log commands.
+func (self *FakeRunner) CallArgs() [][]string {
+	callArgs := make([][]string, len(self.Calls))
+	for i, call := range self.Calls {
+		callArgs[i] = call.Args
+	}
+	return callArgs
+}
@@ -0,0 +1,299 @@
+package hg
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const nullCommitId = "0000000000000000000000000000000000000000"
+
+// A client for the commands of the Mercurial wire protocol that query a
+// remote repository over SSH, by talking to `hg serve --stdio` on the remote
+// host. Only the remote runs hg; locally, ssh is run with the same command
+// line as hg, so that it uses the same keys and known hosts.
+type SshPeer struct {
+	Uri string
+	// a command line that is run by the shell, like ui.ssh of hg, defaults
+	// to ssh
+	SshCommand string
+
+	capabilities []string
+	process      *exec.Cmd
+	stdin        io.WriteCloser
+	stdout       *bufio.Reader
+	stderr       *tailBuffer
+}
+
+func IsSshUri(uri string) bool {
+	return strings.HasPrefix(uri, "ssh://")
+}
+
+// Starts `hg serve --stdio` on the remote host and performs the handshake.
+// Must be called before any other command. ssh is killed once ctx is done,
+// which fails the commands after it.
+func (self *SshPeer) Connect(ctx context.Context) error {
+	sshArgs, err := makeSshArgs(self.Uri)
+	if err != nil {
+		return err
+	}
+
+	sshCommand := self.SshCommand
+	if len(sshCommand) == 0 {
+		sshCommand = "ssh"
+	}
+
+	for _, arg := range sshArgs {
+		sshCommand += " " + ShellQuote(arg)
+	}
+
+	self.process = exec.CommandContext(ctx, "/bin/sh", "-c", sshCommand)
+	// explains why ssh failed, e.g. because the key was refused
+	self.stderr = &tailBuffer{limit: maxStderrSize}
+	self.process.Stderr = self.stderr
+	self.process.WaitDelay = time.Second
+	self.stdin, err = self.process.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("Error connecting to %s: %s", self.Uri, err)
+	}
+	stdout, err := self.process.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("Error connecting to %s: %s", self.Uri, err)
+	}
+	self.stdout = bufio.NewReader(stdout)
+
+	err = self.process.Start()
+	if err != nil {
+		return fmt.Errorf("Error running ssh: %s", err)
+	}
+
+	err = self.handshake()
+	if err != nil {
+		// ssh has written all of its error output once it exited
+		self.Close()
+		message := fmt.Sprintf("Error connecting to %s: %s", self.Uri, err)
+		stderr := self.stderr.String()
+		if len(strings.TrimSpace(stderr)) > 0 {
+			message = fmt.Sprintf("Error connecting to %s: %s", self.Uri, strings.TrimSpace(stderr))
+		}
+		return makePeerError("hello", message, stderr)
+	}
+	return nil
+}
+
+func (self *SshPeer) Close() error {
+	if self.process == nil {
+		return nil
+	}
+
+	// the server exits once its input is closed
+	self.stdin.Close()
+	err := self.process.Wait()
+	self.process = nil
+	return err
+}
+
+// Returns the capabilities the server announced during the handshake.
+func (self *SshPeer) Hello() ([]string, error) {
+	response, err := self.call("hello")
+	if err != nil {
+		return []string{}, err
+	}
+
+	return parseHello(response), nil
+}
+
+// For each pair of commit ids (top, bottom), returns the commits between
+// them at exponentially growing distances from top, as used by discovery in
+// old Mercurial versions.
+func (self *SshPeer) Between(pairs [][2]string) ([][]string, error) {
+	encodedPairs := make([]string, len(pairs))
+	for i, pair := range pairs {
+		encodedPairs[i] = pair[0] + "-" + pair[1]
+	}
+
+	response, err := self.call("between", "pairs", strings.Join(encodedPairs, " "))
+	if err != nil {
+		return [][]string{}, err
+	}
+
+	var result [][]string
+	for _, line := range strings.Split(strings.TrimRight(response, "\n"), "\n") {
+		result = append(result, strings.Fields(line))
+	}
+	return result, nil
+}
+
+// Returns the heads of each named branch, by branch name.
+func (self *SshPeer) BranchMap() (map[string][]string, error) {
+	response, err := self.call("branchmap")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBranchMap(response)
+}
+
+// Resolves a revision identifier, e.g. a branch, bookmark or tag name, to a
+// commit id.
+func (self *SshPeer) Lookup(key string) (string, error) {
+	response, err := self.call("lookup", "key", key)
+	if err != nil {
+		return "", err
+	}
+
+	return parseLookup(key, response)
+}
+
+// Returns the keys of a pushkey namespace, e.g. bookmarks or phases.
+func (self *SshPeer) ListKeys(namespace string) (map[string]string, error) {
+	response, err := self.call("listkeys", "namespace", namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseListKeys(response), nil
+}
+
+// Sends a command with the given name/value argument pairs, and reads the
+// length-prefixed response.
+func (self *SshPeer) call(command string, args ...string) (string, error) {
+	if self.process == nil {
+		return "", fmt.Errorf("Error running %s: not connected", command)
+	}
+
+	request := command + "\n"
+	for i := 0; i+1 < len(args); i += 2 {
+		request += fmt.Sprintf("%s %d\n%s", args[i], len(args[i+1]), args[i+1])
+	}
+
+	// the connection dropped if writing or reading fails
+	_, err := io.WriteString(self.stdin, request)
+	if err != nil {
+		return "", &TransientError{CommandError{
+			Command: command,
+			Message: fmt.Sprintf("Error sending %s to %s: %s", command, self.Uri, err),
+		}}
+	}
+
+	response, err := self.readResponse()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", &TransientError{CommandError{
+			Command: command,
+			Message: fmt.Sprintf("Error reading %s response from %s: %s", command, self.Uri, err),
+		}}
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error reading %s response from %s: %s", command, self.Uri, err)
+	}
+	return response, nil
+}
+
+func (self *SshPeer) readResponse() (string, error) {
+	line, err := self.stdout.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	length, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		return "", fmt.Errorf("expected response length, got '%s'", strings.TrimSpace(line))
+	}
+
+	response := make([]byte, length)
+	_, err = io.ReadFull(self.stdout, response)
+	if err != nil {
+		return "", err
+	}
+	return string(response), nil
+}
+
+// The most lines that may precede the between response, like in hg.
+const maxHandshakeNoise = 500
+
+// Sends hello, followed by a between command with a known response, like hg
+// does. Login banners may precede the responses, so lines are read until the
+// between response, a single empty line with the length 1, and the
+// capabilities are taken from the lines before it. A server that doesn't
+// know hello answers it with an empty response.
+func (self *SshPeer) handshake() error {
+	request := "hello\n" + "between\n" +
+		fmt.Sprintf("pairs %d\n%s-%s", 2*len(nullCommitId)+1, nullCommitId, nullCommitId)
+	_, err := io.WriteString(self.stdin, request)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	previousLine := ""
+	for i := 0; i < maxHandshakeNoise; i++ {
+		line, err := self.stdout.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("no valid response to hello: %s", err)
+		}
+		if previousLine == "1\n" && line == "\n" {
+			self.capabilities = parseHello(strings.Join(lines, ""))
+			return nil
+		}
+		lines = append(lines, line)
+		previousLine = line
+	}
+	return fmt.Errorf("no valid response to hello after %d lines", maxHandshakeNoise)
+}
+
+func parseHello(response string) []string {
+	for _, line := range strings.Split(response, "\n") {
+		if strings.HasPrefix(line, "capabilities:") {
+			return strings.Fields(strings.TrimPrefix(line, "capabilities:"))
+		}
+	}
+	return []string{}
+}
+
+// Turns ssh://[user@]host[:port]/path into the arguments for ssh that run
+// hg serve --stdio on the remote host. Like in hg, the path is relative to
+// the home directory, unless it starts with a second slash.
+func makeSshArgs(uri string) ([]string, error) {
+	parsedUri, err := url.Parse(uri)
+	if err != nil || parsedUri.Scheme != "ssh" || len(parsedUri.Hostname()) == 0 {
+		return []string{}, fmt.Errorf("Error parsing ssh uri '%s'", uri)
+	}
+
+	var args []string
+	if len(parsedUri.Port()) > 0 {
+		args = append(args, "-p", parsedUri.Port())
+	}
+
+	host := parsedUri.Hostname()
+	if parsedUri.User != nil {
+		host = parsedUri.User.Username() + "@" + host
+	}
+	// ssh would read it as an option, e.g. -oProxyCommand=..., which hg
+	// rejects as a potentially unsafe url as well
+	if strings.HasPrefix(host, "-") {
+		return []string{}, fmt.Errorf("Error: potentially unsafe ssh uri '%s'", uri)
+	}
+
+	repoPath := strings.TrimPrefix(parsedUri.Path, "/")
+	if len(repoPath) == 0 {
+		repoPath = "."
+	}
+
+	args = append(args, "--", host, "hg -R "+ShellQuote(repoPath)+" serve --stdio")
+	return args, nil
+}
+
+// Quotes value for sh, unless it only has characters that need no quoting.
+func ShellQuote(value string) string {
+	if len(value) > 0 && strings.Trim(value, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=./:,@") == "" {
+		return value
+	}
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
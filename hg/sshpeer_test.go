@@ -0,0 +1,248 @@
+package hg
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SshPeer", func() {
+	var tempDir string
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "hg-resource-sshpeer")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	// writes an ssh replacement that records its arguments and input, and
+	// replies with the given responses, regardless of the commands sent
+	writeFakeSsh := func(responses ...string) string {
+		var output string
+		for _, response := range responses {
+			output += fmt.Sprintf("%d\n%s", len(response), response)
+		}
+		Expect(ioutil.WriteFile(path.Join(tempDir, "responses"), []byte("Welcome to the server\n"+output), 0644)).To(Succeed())
+
+		script := path.Join(tempDir, "ssh")
+		Expect(ioutil.WriteFile(script, []byte(fmt.Sprintf(
+			"#!/bin/sh\necho \"$@\" > %s/args\ncat %s/responses\ncat > %s/input\n",
+			tempDir, tempDir, tempDir)), 0755)).To(Succeed())
+		return script
+	}
+
+	readFile := func(name string) string {
+		content, err := ioutil.ReadFile(path.Join(tempDir, name))
+		Expect(err).To(BeNil())
+		return string(content)
+	}
+
+	Context("When talking to a fake server", func() {
+		It("performs the handshake past a banner and reads capabilities", func() {
+			peer := &SshPeer{
+				Uri:        "ssh://jdoe@example.com:2222/repos/some'repo",
+				SshCommand: writeFakeSsh("capabilities: lookup branchmap pushkey\n", "\n"),
+			}
+			Expect(peer.Connect(ctx)).To(Succeed())
+			Expect(peer.Close()).To(Succeed())
+
+			Expect(peer.capabilities).To(Equal([]string{"lookup", "branchmap", "pushkey"}))
+			Expect(readFile("args")).To(Equal("-p 2222 -- jdoe@example.com hg -R 'repos/some'\\''repo' serve --stdio\n"))
+			Expect(readFile("input")).To(Equal(fmt.Sprintf("hello\nbetween\npairs 81\n%s-%s", nullCommitId, nullCommitId)))
+		})
+
+		It("looks up revisions", func() {
+			peer := &SshPeer{
+				Uri:        "ssh://example.com//srv/repo",
+				SshCommand: writeFakeSsh("capabilities: lookup\n", "\n", fmt.Sprintf("1 %s\n", someCommitId)),
+			}
+			Expect(peer.Connect(ctx)).To(Succeed())
+			commitId, err := peer.Lookup("default")
+			Expect(err).To(BeNil())
+			Expect(commitId).To(Equal(someCommitId))
+			Expect(peer.Close()).To(Succeed())
+
+			Expect(readFile("args")).To(Equal("-- example.com hg -R /srv/repo serve --stdio\n"))
+			Expect(readFile("input")).To(HaveSuffix("lookup\nkey 7\ndefault"))
+		})
+
+		It("runs the ssh command line with the shell, like hg", func() {
+			peer := &SshPeer{
+				Uri:        "ssh://example.com/repo",
+				SshCommand: writeFakeSsh("capabilities: lookup\n", "\n") + " -o 'UserKnownHostsFile=/some dir/known_hosts'",
+			}
+			Expect(peer.Connect(ctx)).To(Succeed())
+			Expect(peer.Close()).To(Succeed())
+
+			Expect(readFile("args")).To(Equal("-o UserKnownHostsFile=/some dir/known_hosts -- example.com hg -R repo serve --stdio\n"))
+		})
+
+		It("reports failed lookups", func() {
+			peer := &SshPeer{
+				Uri:        "ssh://example.com/repo",
+				SshCommand: writeFakeSsh("", "\n", "0 unknown revision 'bogus'\n"),
+			}
+			Expect(peer.Connect(ctx)).To(Succeed())
+			defer peer.Close()
+
+			_, err := peer.Lookup("bogus")
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("unknown revision 'bogus'"))
+		})
+
+		It("reports a dropped connection as transient", func() {
+			writeFakeSsh("capabilities: lookup\n", "\n")
+			script := path.Join(tempDir, "ssh")
+			Expect(ioutil.WriteFile(script, []byte(fmt.Sprintf("#!/bin/sh\ncat %s/responses\n", tempDir)), 0755)).To(Succeed())
+
+			peer := &SshPeer{Uri: "ssh://example.com/repo", SshCommand: script}
+			Expect(peer.Connect(ctx)).To(Succeed())
+			defer peer.Close()
+
+			_, err := peer.Lookup("default")
+			var transientError *TransientError
+			Expect(errors.As(err, &transientError)).To(BeTrue())
+			Expect(IsTransientError(err)).To(BeTrue())
+		})
+
+		It("parses the branchmap and lists keys", func() {
+			peer := &SshPeer{
+				Uri: "ssh://example.com/repo",
+				SshCommand: writeFakeSsh(
+					"capabilities: branchmap pushkey\n",
+					"\n",
+					fmt.Sprintf("default %s\nsome%%20branch %s\n", someCommitId, otherCommitId),
+					fmt.Sprintf("feature\t%s", otherCommitId),
+				),
+			}
+			Expect(peer.Connect(ctx)).To(Succeed())
+			defer peer.Close()
+
+			branchMap, err := peer.BranchMap()
+			Expect(err).To(BeNil())
+			Expect(branchMap).To(Equal(map[string][]string{
+				"default":     {someCommitId},
+				"some branch": {otherCommitId},
+			}))
+
+			bookmarks, err := peer.ListKeys("bookmarks")
+			Expect(err).To(BeNil())
+			Expect(bookmarks).To(Equal(map[string]string{"feature": otherCommitId}))
+		})
+
+		It("fails if the server never completes the handshake", func() {
+			script := path.Join(tempDir, "ssh")
+			Expect(ioutil.WriteFile(script, []byte("#!/bin/sh\necho 'hg: command not found'\n"), 0755)).To(Succeed())
+
+			peer := &SshPeer{Uri: "ssh://example.com/repo", SshCommand: script}
+			err := peer.Connect(ctx)
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Error connecting to ssh://example.com/repo"))
+		})
+	})
+
+	Context("When ssh fails or the server greets with a banner", func() {
+		It("reports ssh's error output, classified like hg's", func() {
+			script := path.Join(tempDir, "ssh")
+			Expect(ioutil.WriteFile(script, []byte("#!/bin/sh\necho 'git@example.com: Permission denied (publickey).' >&2\nexit 255\n"), 0755)).To(Succeed())
+
+			peer := &SshPeer{Uri: "ssh://example.com/repo", SshCommand: script}
+			err := peer.Connect(ctx)
+			var authenticationError *AuthenticationError
+			Expect(errors.As(err, &authenticationError)).To(BeTrue())
+			Expect(err.Error()).To(Equal("Error connecting to ssh://example.com/repo: git@example.com: Permission denied (publickey)."))
+
+			Expect(ioutil.WriteFile(script, []byte("#!/bin/sh\necho 'Host key verification failed.' >&2\nexit 255\n"), 0755)).To(Succeed())
+			err = peer.Connect(ctx)
+			var hostKeyError *HostKeyError
+			Expect(errors.As(err, &hostKeyError)).To(BeTrue())
+		})
+
+		It("skips banner lines that look like response lengths", func() {
+			Expect(ioutil.WriteFile(path.Join(tempDir, "responses"), []byte(
+				"Welcome\n42\n\n1\n"+"38\ncapabilities: lookup branchmap pushkey\n"+"1\n\n"), 0644)).To(Succeed())
+			script := path.Join(tempDir, "ssh")
+			Expect(ioutil.WriteFile(script, []byte(fmt.Sprintf("#!/bin/sh\ncat %s/responses\ncat > /dev/null\n", tempDir)), 0755)).To(Succeed())
+
+			peer := &SshPeer{Uri: "ssh://example.com/repo", SshCommand: script}
+			Expect(peer.Connect(ctx)).To(Succeed())
+			Expect(peer.Close()).To(Succeed())
+			Expect(peer.capabilities).To(Equal([]string{"lookup", "branchmap", "pushkey"}))
+		})
+	})
+
+	Context("When parsing uris", func() {
+		It("rejects uris without a host", func() {
+			_, err := makeSshArgs("ssh:///repo")
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("defaults to the home directory", func() {
+			args, err := makeSshArgs("ssh://example.com")
+			Expect(err).To(BeNil())
+			Expect(args).To(Equal([]string{"--", "example.com", "hg -R . serve --stdio"}))
+		})
+
+		It("rejects hosts that ssh would read as options", func() {
+			_, err := makeSshArgs("ssh://-oProxyCommand=touch%20pwned/repo")
+			Expect(err).ToNot(BeNil())
+			_, err = makeSshArgs("ssh://-oProxyCommand=x@example.com/repo")
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("potentially unsafe"))
+		})
+	})
+
+	Context("When talking to hg serve --stdio", func() {
+		It("looks up branches and bookmarks and answers between", func() {
+			_, err := exec.LookPath("hg")
+			if err != nil {
+				Skip("hg is not installed")
+			}
+
+			repoDir := path.Join(tempDir, "repo")
+			Expect(os.Mkdir(repoDir, 0755)).To(Succeed())
+			runHg(repoDir, "init")
+			Expect(ioutil.WriteFile(path.Join(repoDir, "a_file"), []byte("x"), 0644)).To(Succeed())
+			runHg(repoDir, "commit", "-A", "-m", "init", "--user", "test <test@example.com>")
+			runHg(repoDir, "bookmark", "feature")
+			tipId := runHg(repoDir, "log", "--rev", "tip", "--template", "{node}")
+
+			// runs the remote command locally instead of on the host
+			script := path.Join(tempDir, "ssh")
+			Expect(ioutil.WriteFile(script, []byte("#!/bin/sh\nshift $(($# - 1))\nexec sh -c \"$1\"\n"), 0755)).To(Succeed())
+
+			peer := &SshPeer{Uri: "ssh://localhost/" + repoDir, SshCommand: script}
+			Expect(peer.Connect(ctx)).To(Succeed())
+			defer peer.Close()
+
+			Expect(peer.capabilities).To(ContainElement("lookup"))
+
+			commitId, err := peer.Lookup("default")
+			Expect(err).To(BeNil())
+			Expect(commitId).To(Equal(tipId))
+
+			bookmarks, err := peer.ListKeys("bookmarks")
+			Expect(err).To(BeNil())
+			Expect(bookmarks).To(HaveKeyWithValue("feature", tipId))
+
+			between, err := peer.Between([][2]string{{tipId, nullCommitId}})
+			Expect(err).To(BeNil())
+			Expect(between).To(HaveLen(1))
+
+			capabilities, err := peer.Hello()
+			Expect(err).To(BeNil())
+			Expect(strings.Join(capabilities, " ")).To(ContainSubstring("branchmap"))
+		})
+	})
+})
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/concourse/hg-resource/hg"
+)
+
+// The username sent along with a token if none is configured. Servers that
+// accept tokens ignore it.
+const defaultTokenUsername = "token"
+
+// Returns nil if the source has no credentials besides the ones in its uri.
+// The client certificate is taken from files, see writeTlsFiles. The password
+// is written to a file, which has to be removed with HttpAuth.Remove.
+func makeHttpAuth(source *Source, files *tlsFiles) (*hg.HttpAuth, error) {
+	hasClientCert := files != nil && len(files.ClientCert) > 0
+	if len(source.Username) == 0 && len(source.Password) == 0 && len(source.Token) == 0 && !hasClientCert {
+		return nil, nil
+	}
+	if len(source.Password) > 0 && len(source.Token) > 0 {
+		return nil, fmt.Errorf("Error: password and token must not both be set")
+	}
+	if !hg.IsHttpUri(source.Uri) {
+		return nil, fmt.Errorf("Error: username, password, token and client certificates are only supported for http(s) uris")
+	}
+
+	auth := &hg.HttpAuth{
+		Uri:      source.Uri,
+		Username: source.Username,
+		Password: source.Password,
+	}
+	if hasClientCert {
+		auth.CertFile = files.ClientCert
+		auth.KeyFile = files.ClientKey
+	}
+	if len(source.Token) > 0 {
+		auth.Password = source.Token
+		if len(auth.Username) == 0 {
+			auth.Username = defaultTokenUsername
+		}
+	}
+	if len(auth.Password) > 0 && len(auth.Username) == 0 {
+		return nil, fmt.Errorf("Error: password requires username")
+	}
+	err := auth.WriteConfigFile(getTempDir())
+	if err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// The PEM files of the TLS options of a source, in a directory only the
+// resource can read. Paths of options that are not set are empty.
+type tlsFiles struct {
+	dir        string
+	CaCerts    string
+	ClientCert string
+	ClientKey  string
+}
+
+// Returns nil if the source has no TLS options. The certificates and key are
+// checked before they are written, so that mistakes are reported as such,
+// and not as TLS errors of hg.
+func writeTlsFiles(source *Source) (*tlsFiles, error) {
+	if len(source.CaCert) == 0 && len(source.ClientCert) == 0 && len(source.ClientKey) == 0 {
+		return nil, nil
+	}
+	if !hg.IsHttpUri(source.Uri) {
+		return nil, fmt.Errorf("Error: ca_cert, client_cert and client_key are only supported for http(s) uris")
+	}
+	if (len(source.ClientCert) > 0) != (len(source.ClientKey) > 0) {
+		return nil, fmt.Errorf("Error: client_cert and client_key must be set together")
+	}
+	if len(source.CaCert) > 0 && !x509.NewCertPool().AppendCertsFromPEM([]byte(source.CaCert)) {
+		return nil, fmt.Errorf("Error: ca_cert does not contain a PEM encoded certificate")
+	}
+	if len(source.ClientCert) > 0 {
+		_, err := tls.X509KeyPair([]byte(source.ClientCert), []byte(source.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("Error: invalid client_cert or client_key: %s", err)
+		}
+	}
+
+	dir, err := ioutil.TempDir(getTempDir(), "hg-resource-tls-")
+	if err != nil {
+		return nil, fmt.Errorf("Error creating directory for TLS files: %s", err)
+	}
+	files := &tlsFiles{dir: dir}
+
+	for _, file := range []struct {
+		content string
+		name    string
+		path    *string
+	}{
+		{source.CaCert, "ca.pem", &files.CaCerts},
+		{source.ClientCert, "client-cert.pem", &files.ClientCert},
+		{source.ClientKey, "client-key.pem", &files.ClientKey},
+	} {
+		if len(file.content) == 0 {
+			continue
+		}
+		*file.path = path.Join(dir, file.name)
+		err = ioutil.WriteFile(*file.path, []byte(file.content), 0600)
+		if err != nil {
+			files.Remove()
+			return nil, fmt.Errorf("Error writing %s: %s", file.name, err)
+		}
+	}
+	return files, nil
+}
+
+func (files *tlsFiles) Remove() error {
+	if files == nil {
+		return nil
+	}
+	return os.RemoveAll(files.dir)
+}
+
+var sha256HexPattern = regexp.MustCompile("^[0-9a-fA-F]{64}$")
+
+// Checks that each host has sha256 fingerprints like hg prints them, e.g.
+// "sha256:4e:1f:...", and returns them by host.
+func makeHostFingerprints(source *Source) (map[string][]string, error) {
+	if len(source.HostFingerprints) == 0 {
+		return nil, nil
+	}
+
+	hostFingerprints := map[string][]string{}
+	for host, fingerprints := range source.HostFingerprints {
+		if len(host) == 0 || strings.ContainsAny(host, "/: ") {
+			return nil, fmt.Errorf("Error: invalid host '%s' in host_fingerprints, expected a host name like hg.example.com", host)
+		}
+		if len(fingerprints) == 0 {
+			return nil, fmt.Errorf("Error: no fingerprints for host '%s' in host_fingerprints", host)
+		}
+		for _, fingerprint := range fingerprints {
+			hexDigits := strings.Replace(strings.TrimPrefix(fingerprint, "sha256:"), ":", "", -1)
+			if !strings.HasPrefix(fingerprint, "sha256:") || !sha256HexPattern.MatchString(hexDigits) {
+				return nil, fmt.Errorf("Error: invalid fingerprint '%s' for host '%s' in host_fingerprints, expected a sha256 fingerprint like sha256:4e:1f:...", fingerprint, host)
+			}
+		}
+		hostFingerprints[host] = fingerprints
+	}
+	return hostFingerprints, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/concourse/hg-resource/hg"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Auth", func() {
+	Context("When configuring HTTP credentials", func() {
+		BeforeEach(func() {
+			// hg is not asked for its configuration files
+			os.Setenv("HGRCPATH", "")
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("HGRCPATH")
+		})
+
+		It("has none by default", func() {
+			auth, err := makeHttpAuth(&Source{Uri: "https://example.com/repo"}, nil)
+			Expect(err).To(BeNil())
+			Expect(auth).To(BeNil())
+		})
+
+		It("uses the username and password for the uri, and writes the password to a file", func() {
+			auth, err := makeHttpAuth(&Source{Uri: "https://example.com/repo", Username: "jdoe", Password: "secret"}, nil)
+			Expect(err).To(BeNil())
+			defer auth.Remove()
+			Expect(auth.ConfigFile).ToNot(BeEmpty())
+			Expect(auth).To(Equal(&hg.HttpAuth{Uri: "https://example.com/repo", Username: "jdoe", Password: "secret", ConfigFile: auth.ConfigFile}))
+
+			config, err := ioutil.ReadFile(auth.ConfigFile)
+			Expect(err).To(BeNil())
+			Expect(string(config)).To(ContainSubstring("hg-resource.password = secret"))
+		})
+
+		It("sends a token as the password", func() {
+			auth, err := makeHttpAuth(&Source{Uri: "https://example.com/repo", Token: "a-token"}, nil)
+			Expect(err).To(BeNil())
+			defer auth.Remove()
+			Expect(auth).To(Equal(&hg.HttpAuth{Uri: "https://example.com/repo", Username: "token", Password: "a-token", ConfigFile: auth.ConfigFile}))
+		})
+
+		It("rejects incomplete or conflicting credentials", func() {
+			_, err := makeHttpAuth(&Source{Uri: "https://example.com/repo", Password: "secret"}, nil)
+			Expect(err).To(MatchError("Error: password requires username"))
+
+			_, err = makeHttpAuth(&Source{Uri: "https://example.com/repo", Username: "jdoe", Password: "secret", Token: "a-token"}, nil)
+			Expect(err).To(MatchError("Error: password and token must not both be set"))
+
+			_, err = makeHttpAuth(&Source{Uri: "ssh://example.com/repo", Username: "jdoe", Password: "secret"}, nil)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("uses the client certificate", func() {
+			auth, err := makeHttpAuth(&Source{Uri: "https://example.com/repo"}, &tlsFiles{ClientCert: "/tls/cert.pem", ClientKey: "/tls/key.pem"})
+			Expect(err).To(BeNil())
+			Expect(auth).To(Equal(&hg.HttpAuth{Uri: "https://example.com/repo", CertFile: "/tls/cert.pem", KeyFile: "/tls/key.pem"}))
+		})
+	})
+
+	Context("When pinning host fingerprints", func() {
+		fingerprint := "sha256:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab:ab"
+
+		It("accepts sha256 fingerprints with or without colons", func() {
+			hostFingerprints, err := makeHostFingerprints(&Source{HostFingerprints: map[string]Fingerprints{
+				"hg.example.com": {fingerprint, "sha256:" + strings.Repeat("CD", 32)},
+			}})
+			Expect(err).To(BeNil())
+			Expect(hostFingerprints).To(Equal(map[string][]string{
+				"hg.example.com": {fingerprint, "sha256:" + strings.Repeat("CD", 32)},
+			}))
+		})
+
+		It("rejects other fingerprints and hosts", func() {
+			_, err := makeHostFingerprints(&Source{HostFingerprints: map[string]Fingerprints{"hg.example.com": {"sha1:ab:cd"}}})
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("invalid fingerprint 'sha1:ab:cd' for host 'hg.example.com'"))
+
+			_, err = makeHostFingerprints(&Source{HostFingerprints: map[string]Fingerprints{"https://hg.example.com": {fingerprint}}})
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("invalid host 'https://hg.example.com'"))
+		})
+	})
+
+	Context("When writing TLS files", func() {
+		var certPem, keyPem string
+
+		BeforeEach(func() {
+			certPem, keyPem = makeTestCertificate()
+		})
+
+		It("writes nothing without TLS options", func() {
+			files, err := writeTlsFiles(&Source{Uri: "https://example.com/repo"})
+			Expect(err).To(BeNil())
+			Expect(files).To(BeNil())
+		})
+
+		It("writes files only the resource can read, and removes them", func() {
+			files, err := writeTlsFiles(&Source{Uri: "https://example.com/repo", CaCert: certPem, ClientCert: certPem, ClientKey: keyPem})
+			Expect(err).To(BeNil())
+
+			for _, file := range []string{files.CaCerts, files.ClientCert, files.ClientKey} {
+				info, err := os.Stat(file)
+				Expect(err).To(BeNil())
+				Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			}
+			key, err := ioutil.ReadFile(files.ClientKey)
+			Expect(err).To(BeNil())
+			Expect(string(key)).To(Equal(keyPem))
+
+			Expect(files.Remove()).To(Succeed())
+			_, err = os.Stat(files.ClientKey)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("rejects invalid certificates and keys", func() {
+			_, err := writeTlsFiles(&Source{Uri: "https://example.com/repo", CaCert: "not a certificate"})
+			Expect(err).To(MatchError("Error: ca_cert does not contain a PEM encoded certificate"))
+
+			_, err = writeTlsFiles(&Source{Uri: "https://example.com/repo", ClientCert: certPem})
+			Expect(err).To(MatchError("Error: client_cert and client_key must be set together"))
+
+			_, otherKeyPem := makeTestCertificate()
+			_, err = writeTlsFiles(&Source{Uri: "https://example.com/repo", ClientCert: certPem, ClientKey: otherKeyPem})
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("invalid client_cert or client_key"))
+		})
+	})
+})
+
+// Returns a self-signed certificate and its key, PEM encoded.
+func makeTestCertificate() (certPem string, keyPem string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hg-resource"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+
+	certPem = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPem = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	return
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/concourse/hg-resource/hg"
 	"io"
 	"path"
+	"strings"
+	"time"
 )
 
 const cmdCheckName string = "check"
@@ -17,13 +23,25 @@ var cmdCheck = &Command{
 
 func runCheck(args []string, params *JsonInput, outWriter io.Writer, errWriter io.Writer) int {
 	repo := hg.Repository{
-		Path:                getCacheDir(),
+		Path:                getCacheDir(&params.Source),
 		Branch:              params.Source.Branch,
+		Bookmark:            params.Source.Bookmark,
+		Branches:            params.Source.Branches,
 		IncludePaths:        params.Source.IncludePaths,
 		ExcludePaths:        params.Source.ExcludePaths,
+		Authors:             params.Source.Authors,
+		IgnoreAuthors:       params.Source.IgnoreAuthors,
+		Merges:              params.Source.Merges,
 		TagFilter:           params.Source.TagFilter,
 		RevSetFilter:        params.Source.RevSetFilter,
+		InitialRef:          params.Source.InitialRef,
+		SinceDate:           params.Source.SinceDate,
+		Phases:              params.Source.Phases,
+		SkipCiPatterns:      params.Source.SkipCiPatterns,
+		DisableCiSkip:       params.Source.DisableCiSkip,
+		Evolution:           params.Source.Evolution,
 		SkipSslVerification: params.Source.SkipSslVerification,
+		Timestamps:          params.Source.LogTimestamps,
 	}
 
 	if len(repo.Branch) == 0 {
@@ -35,26 +53,185 @@ func runCheck(args []string, params *JsonInput, outWriter io.Writer, errWriter i
 		return 1
 	}
 
-	output, err := repo.CloneOrPull(params.Source.Uri)
-	errWriter.Write(output)
+	err := validatePhases(params.Source.Phases)
 	if err != nil {
 		fmt.Fprintln(errWriter, err)
 		return 1
 	}
 
-	if len(params.Version.Ref) == 0 {
-		return writeLatestCommit(&repo, outWriter, errWriter)
+	err = validateMerges(params.Source.Merges)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	repo.Timeout, repo.NetworkTimeout, err = parseTimeouts(&params.Source)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	repo.Retries, repo.RetryBackoff, err = parseRetries(&params.Source)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+	repo.Stderr = errWriter
+
+	certFiles, err := writeTlsFiles(&params.Source)
+	defer certFiles.Remove()
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+	if certFiles != nil {
+		repo.CaCertsFile = certFiles.CaCerts
+	}
+
+	repo.HttpAuth, err = makeHttpAuth(&params.Source, certFiles)
+	defer repo.HttpAuth.Remove()
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	repo.HostFingerprints, err = makeHostFingerprints(&params.Source)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	sshConf, err := setUpSsh(&params.Source)
+	defer sshConf.Close()
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+	repo.SshCommand = sshConf.Command
+
+	runner, err := startRunner(&params.Source, repo.HttpAuth)
+	defer stopRunner(runner, errWriter)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+	repo.Runner = runner
+	ctx := context.Background()
+
+	// answer from the remote head if possible, which avoids cloning or
+	// pulling. The lookup does not know hg's configuration, e.g. proxies or
+	// schemes, so if it fails, hg may still succeed.
+	if canUseRemoteHead(&repo, params.Version) {
+		remoteHead, err := repo.GetRemoteHead(ctx, params.Source.Uri)
+		if err == nil {
+			return writeVersions([]Version{Version{Ref: remoteHead}}, outWriter, errWriter)
+		}
+		fmt.Fprintf(errWriter, "Looking up the remote head failed, pulling instead: %s\n", err)
+	}
+
+	err = repo.CloneOrPull(ctx, params.Source.Uri)
+	if err != nil {
+		fmt.Fprintln(errWriter, explainError(err))
+		return 1
+	}
+
+	err = repo.ResolveInitialRef(ctx)
+	if err == hg.ErrCommitNotFound {
+		fmt.Fprintf(errWriter, "Error: initial_ref %s not found in %s\n", repo.InitialRef, hg.RedactUri(params.Source.Uri))
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	// a bounded source emits all versions on the first check, so that
+	// pipelines can be back-filled
+	if repo.IsBounded() && len(params.Version.Ref) == 0 {
+		return writeAllCommits(ctx, &repo, outWriter, errWriter)
+	} else if len(repo.Branches) > 0 && len(params.Version.Ref) == 0 {
+		return writeLatestCommitPerBranch(ctx, &repo, outWriter, errWriter)
+	} else if len(repo.Branches) > 0 {
+		return writeBranchCommitsSince(ctx, params.Version.Ref, &repo, outWriter, errWriter)
+	} else if len(params.Version.Ref) == 0 {
+		return writeLatestCommit(ctx, &repo, outWriter, errWriter)
 	} else {
-		return writeCommitsSince(params.Version.Ref, &repo, outWriter, errWriter)
+		return writeCommitsSince(ctx, params.Version.Ref, &repo, outWriter, errWriter)
 	}
 }
 
-func getCacheDir() string {
-	return path.Join(getTempDir(), "hg-resource-repo-cache")
+// Whether the remote head alone answers a check, i.e. whether it is what a
+// clone would emit. Only the first check emits just the latest commit, and
+// only if no option may skip the head, e.g. by its files or its message.
+// Checks of several branches need all of their heads.
+func canUseRemoteHead(repo *hg.Repository, version Version) bool {
+	return len(version.Ref) == 0 && len(repo.Branches) == 0 && !repo.NeedsHistory()
 }
 
-func writeLatestCommit(repo *hg.Repository, outWriter io.Writer, errWriter io.Writer) int {
-	latestCommit, err := repo.GetLatestCommitId()
+func validatePhases(phases []string) error {
+	for _, phase := range phases {
+		isKnown := false
+		for _, knownPhase := range hg.Phases {
+			isKnown = isKnown || phase == knownPhase
+		}
+		if !isKnown {
+			return fmt.Errorf("Error: invalid phase '%s', expected one of: %s", phase, strings.Join(hg.Phases, ", "))
+		}
+	}
+	return nil
+}
+
+func validateMerges(merges string) error {
+	if len(merges) == 0 {
+		return nil
+	}
+	for _, mode := range hg.MergeModes {
+		if merges == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("Error: invalid merges option '%s', expected one of: %s", merges, strings.Join(hg.MergeModes, ", "))
+}
+
+// Both timeouts are optional durations like "10m", see time.ParseDuration.
+func parseTimeouts(source *Source) (timeout time.Duration, networkTimeout time.Duration, err error) {
+	timeout, err = parseDuration("timeout", source.Timeout)
+	if err != nil {
+		return
+	}
+	networkTimeout, err = parseDuration("network_timeout", source.NetworkTimeout)
+	return
+}
+
+// The backoff is an optional duration like "5s", see time.ParseDuration.
+func parseRetries(source *Source) (retries int, retryBackoff time.Duration, err error) {
+	if source.Retries < 0 {
+		err = fmt.Errorf("Error: invalid retries '%d', expected a number of retries of at least 0", source.Retries)
+		return
+	}
+	retryBackoff, err = parseDuration("retry_backoff", source.RetryBackoff)
+	return source.Retries, retryBackoff, err
+}
+
+func parseDuration(name string, value string) (time.Duration, error) {
+	if len(value) == 0 {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("Error: invalid %s '%s', expected a positive duration like 10m or 30s", name, value)
+	}
+	return duration, nil
+}
+
+// Each source gets its own cache, so that sources sharing a container never
+// pull from each other's repositories.
+func getCacheDir(source *Source) string {
+	return path.Join(getTempDir(), "hg-resource-repo-cache-"+source.cacheKey())
+}
+
+func writeLatestCommit(ctx context.Context, repo *hg.Repository, outWriter io.Writer, errWriter io.Writer) int {
+	latestCommit, err := repo.GetLatestCommitId(ctx)
 	if err != nil {
 		fmt.Fprintln(errWriter, err)
 		return 1
@@ -74,11 +251,15 @@ func writeLatestCommit(repo *hg.Repository, outWriter io.Writer, errWriter io.Wr
 	return 0
 }
 
-func writeCommitsSince(parentCommit string, repo *hg.Repository, outWriter io.Writer, errWriter io.Writer) int {
-	commits, err := repo.GetDescendantsOf(parentCommit)
-	if err != nil {
+func writeCommitsSince(ctx context.Context, parentCommit string, repo *hg.Repository, outWriter io.Writer, errWriter io.Writer) int {
+	commits, err := repo.GetDescendantsOf(ctx, parentCommit)
+	if err == hg.ErrCommitNotFound {
 		// commit id not found -- return latest commit as fallback
-		return writeLatestCommit(repo, outWriter, errWriter)
+		return writeLatestCommit(ctx, repo, outWriter, errWriter)
+	}
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
 	}
 
 	commitList := make([]Version, len(commits))
@@ -96,3 +277,103 @@ func writeCommitsSince(parentCommit string, repo *hg.Repository, outWriter io.Wr
 
 	return 0
 }
+
+func writeAllCommits(ctx context.Context, repo *hg.Repository, outWriter io.Writer, errWriter io.Writer) int {
+	commits, err := repo.GetAllCommits(ctx)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	// only versions of multi-branch sources carry their branch
+	if len(repo.Branches) == 0 {
+		for i := range commits {
+			commits[i].Branch = ""
+		}
+	}
+
+	return writeBranchCommits(commits, outWriter, errWriter)
+}
+
+func writeLatestCommitPerBranch(ctx context.Context, repo *hg.Repository, outWriter io.Writer, errWriter io.Writer) int {
+	commits, err := repo.GetLatestCommitPerBranch(ctx)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	return writeBranchCommits(commits, outWriter, errWriter)
+}
+
+func writeBranchCommitsSince(ctx context.Context, parentCommit string, repo *hg.Repository, outWriter io.Writer, errWriter io.Writer) int {
+	commits, err := repo.GetCommitsSince(ctx, parentCommit)
+	if err == hg.ErrCommitNotFound {
+		// commit id not found -- return latest commits as fallback
+		return writeLatestCommitPerBranch(ctx, repo, outWriter, errWriter)
+	}
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	return writeBranchCommits(commits, outWriter, errWriter)
+}
+
+func writeBranchCommits(commits []hg.BranchCommit, outWriter io.Writer, errWriter io.Writer) int {
+	commitList := make([]Version, len(commits))
+	for i, commit := range commits {
+		commitList[i] = Version{
+			Ref:    commit.Id,
+			Branch: commit.Branch,
+		}
+	}
+
+	_, err := WriteJson(outWriter, commitList)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	return 0
+}
+
+func writeVersions(versions []Version, outWriter io.Writer, errWriter io.Writer) int {
+	_, err := WriteJson(outWriter, versions)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	return 0
+}
+
+// The parts of a source that determine what ends up in the cache. Options
+// that only filter the version stream are left out, so that sources which
+// merely differ in their filters share a cache.
+type cacheIdentity struct {
+	Uri       string   `json:"uri"`
+	Branch    string   `json:"branch"`
+	Bookmark  string   `json:"bookmark"`
+	Branches  []string `json:"branches"`
+	Evolution bool     `json:"evolution"`
+}
+
+func (source *Source) cacheKey() string {
+	identity := cacheIdentity{
+		// the same normalization as the check of the cached clone's
+		// source, so that they agree on which uris are the same
+		Uri:       hg.NormalizeUri(source.Uri),
+		Branch:    source.Branch,
+		Bookmark:  source.Bookmark,
+		Branches:  source.Branches,
+		Evolution: source.Evolution,
+	}
+	if len(identity.Branch) == 0 {
+		identity.Branch = defaultBranch
+	}
+
+	// marshalling a struct of strings cannot fail
+	identityJson, _ := json.Marshal(identity)
+	hash := sha256.Sum256(identityJson)
+	return hex.EncodeToString(hash[:])[:16]
+}
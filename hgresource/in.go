@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/concourse/hg-resource/hg"
 	"io"
@@ -21,51 +23,146 @@ func runIn(args []string, params *JsonInput, outWriter io.Writer, errWriter io.W
 	repo := &hg.Repository{
 		Path:                destination,
 		Branch:              params.Source.Branch,
+		Bookmark:            params.Source.Bookmark,
+		Branches:            params.Source.Branches,
 		IncludePaths:        params.Source.IncludePaths,
 		ExcludePaths:        params.Source.ExcludePaths,
+		Authors:             params.Source.Authors,
+		IgnoreAuthors:       params.Source.IgnoreAuthors,
+		Merges:              params.Source.Merges,
 		TagFilter:           params.Source.TagFilter,
 		RevSetFilter:        params.Source.RevSetFilter,
+		InitialRef:          params.Source.InitialRef,
+		SinceDate:           params.Source.SinceDate,
+		Phases:              params.Source.Phases,
+		SkipCiPatterns:      params.Source.SkipCiPatterns,
+		DisableCiSkip:       params.Source.DisableCiSkip,
+		Evolution:           params.Source.Evolution,
 		SkipSslVerification: params.Source.SkipSslVerification,
+		Timestamps:          params.Source.LogTimestamps,
 	}
 
 	if len(repo.Branch) == 0 {
 		repo.Branch = defaultBranch
 	}
 
+	// versions of multi-branch sources carry the branch they were found on
+	if len(params.Version.Branch) > 0 {
+		repo.Branch = params.Version.Branch
+		repo.Branches = nil
+	}
+
 	if len(params.Source.Uri) == 0 {
 		fmt.Fprintln(errWriter, "Repository URI must be provided")
 		return 1
 	}
 
+	err := validatePhases(params.Source.Phases)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	err = validateMerges(params.Source.Merges)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	repo.Timeout, repo.NetworkTimeout, err = parseTimeouts(&params.Source)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	repo.Retries, repo.RetryBackoff, err = parseRetries(&params.Source)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+	repo.Stderr = errWriter
+
+	certFiles, err := writeTlsFiles(&params.Source)
+	defer certFiles.Remove()
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+	if certFiles != nil {
+		repo.CaCertsFile = certFiles.CaCerts
+	}
+
+	repo.HttpAuth, err = makeHttpAuth(&params.Source, certFiles)
+	defer repo.HttpAuth.Remove()
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	repo.HostFingerprints, err = makeHostFingerprints(&params.Source)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	sshConf, err := setUpSsh(&params.Source)
+	defer sshConf.Close()
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+	repo.SshCommand = sshConf.Command
+
+	runner, err := startRunner(&params.Source, repo.HttpAuth)
+	defer stopRunner(runner, errWriter)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+	repo.Runner = runner
+	ctx := context.Background()
+
 	var commitId string
-	if len(params.Version.Ref) == 0 {
+	if len(params.Version.Ref) == 0 && len(repo.Bookmark) > 0 {
+		commitId = repo.Bookmark
+	} else if len(params.Version.Ref) == 0 {
 		commitId = "tip"
 	} else {
 		commitId = params.Version.Ref
 	}
 
-	output, err := repo.CloneOrPull(params.Source.Uri)
-	errWriter.Write(output)
+	err = repo.CloneOrPull(ctx, params.Source.Uri)
 	if err != nil {
-		fmt.Fprintln(errWriter, err)
+		fmt.Fprintln(errWriter, explainError(err))
 		return 1
 	}
 
-	output, err = repo.Checkout(commitId)
-	errWriter.Write(output)
+	if len(params.Version.Ref) == 0 && len(repo.Branches) > 0 {
+		commitId, err = repo.GetLatestCommitId(ctx)
+		if err != nil {
+			fmt.Fprintln(errWriter, err)
+			return 1
+		}
+	}
+
+	err = repo.Checkout(ctx, commitId)
+	var unknownRevisionError *hg.UnknownRevisionError
+	if errors.As(err, &unknownRevisionError) {
+		fmt.Fprintf(errWriter, "Error: version %s is not in the repository, it may have been stripped or pruned\n", commitId)
+		return 1
+	}
 	if err != nil {
 		fmt.Fprintln(errWriter, err)
 		return 1
 	}
 
-	output, err = repo.Purge()
-	errWriter.Write(output)
+	err = repo.Purge(ctx)
 	if err != nil {
 		fmt.Fprintln(errWriter, err)
 		return 1
 	}
 
-	jsonOutput, err := getJsonOutputForCurrentCommit(repo)
+	jsonOutput, err := getJsonOutputForCurrentCommit(ctx, repo, len(params.Source.Branches) > 0)
 	if err != nil {
 		fmt.Fprintln(errWriter, err)
 		return 1
@@ -26,6 +26,7 @@ var _ = Describe("Json", func() {
 						"path/6"
 					],
 					"branch": "a_branch",
+					"bookmark": "a_bookmark",
 					"tag_filter": "staging",
 					"revset_filter": "public()",
 					"skip_ssl_verification": true
@@ -61,6 +62,44 @@ var _ = Describe("Json", func() {
 			Expect(result.Version.Ref).To(Equal("abc"))
 		})
 
+		It("accepts a list of branches", func() {
+			var result JsonInput
+			err := json.Unmarshal([]byte(`{"source": {"branches": ["release/1", "re:^hotfix/"]}}`), &result)
+			Expect(err).To(BeNil())
+			Expect(result.Source.Branches).To(Equal(Branches{"release/1", "re:^hotfix/"}))
+		})
+
+		It("accepts a regular expression as branches", func() {
+			var result JsonInput
+			err := json.Unmarshal([]byte(`{"source": {"branches": "^release/"}}`), &result)
+			Expect(err).To(BeNil())
+			Expect(result.Source.Branches).To(Equal(Branches{"re:^release/"}))
+		})
+
+		It("accepts a fingerprint or a list of them per host", func() {
+			var result JsonInput
+			err := json.Unmarshal([]byte(`{"source": {"host_fingerprints": {"a.example.com": "sha256:ab", "b.example.com": ["sha256:cd", "sha256:ef"]}}}`), &result)
+			Expect(err).To(BeNil())
+			Expect(result.Source.HostFingerprints).To(Equal(map[string]Fingerprints{
+				"a.example.com": {"sha256:ab"},
+				"b.example.com": {"sha256:cd", "sha256:ef"},
+			}))
+		})
+
+		It("deserializes the branch of a version", func() {
+			var result JsonInput
+			err := json.Unmarshal([]byte(`{"version": {"ref": "abc", "branch": "release/1"}}`), &result)
+			Expect(err).To(BeNil())
+			Expect(result.Version.Ref).To(Equal("abc"))
+			Expect(result.Version.Branch).To(Equal("release/1"))
+		})
+
+		It("omits the branch of a version if it is not set", func() {
+			output, err := json.Marshal(Version{Ref: "abc"})
+			Expect(err).To(BeNil())
+			Expect(string(output)).To(Equal(`{"ref":"abc"}`))
+		})
+
 		It("readAllBytes reads all bytes", func() {
 			bytes, err := readAllBytes(buf)
 
@@ -83,11 +122,17 @@ var _ = Describe("Json", func() {
 			Expect(result.Source.ExcludePaths[1]).To(Equal("path/5"))
 			Expect(result.Source.ExcludePaths[2]).To(Equal("path/6"))
 			Expect(result.Source.Branch).To(Equal("a_branch"))
+			Expect(result.Source.Bookmark).To(Equal("a_bookmark"))
 			Expect(result.Source.SkipSslVerification).To(BeTrue())
 			Expect(result.Source.TagFilter).To(Equal("staging"))
 			Expect(result.Source.RevSetFilter).To(Equal("public()"))
 			Expect(result.Version.Ref).To(Equal("abc"))
 		})
+
+		It("parseInput fails on invalid input", func() {
+			_, err := parseInput(bytes.NewBufferString(`{"source": {"branches": 42}}`))
+			Expect(err).ToNot(BeNil())
+		})
 	})
 
 })
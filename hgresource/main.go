@@ -5,7 +5,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"github.com/concourse/hg-resource/hg"
 	"io"
 	"os"
 	"path"
@@ -63,16 +65,6 @@ func run(args []string, inReader io.Reader, outWriter io.Writer, errWriter io.Wr
 		return 1
 	}
 
-	// run ssh-agent
-	if len(input.Source.PrivateKey) != 0 {
-		err := loadSshPrivateKey(input.Source.PrivateKey)
-		defer cleanupSshAgent(os.Stderr)
-		if err != nil {
-			fmt.Fprintln(errWriter, err)
-			return 1
-		}
-	}
-
 	return handler.Run(handlerArgs, input, os.Stdout, os.Stderr)
 }
 
@@ -115,9 +107,51 @@ func usage(errWriter io.Writer) {
 	fmt.Fprintln(errWriter, makeUsage())
 }
 
-func cleanupSshAgent(errWriter io.Writer) {
-	err := killSshAgent()
+// Returns the runner for hg commands: an hg command server if the source
+// asks for one, and separate hg processes otherwise. The server is started
+// with the configuration file of auth, as it cannot read it later.
+func startRunner(source *Source, auth *hg.HttpAuth) (hg.Runner, error) {
+	if !source.CommandServer {
+		return &hg.ExecRunner{}, nil
+	}
+
+	server, err := hg.StartCommandServer(auth.Env())
 	if err != nil {
-		fmt.Fprintf(errWriter, "Error in cleanup: %s\n", err)
+		return nil, err
+	}
+	return server, nil
+}
+
+func stopRunner(runner hg.Runner, errWriter io.Writer) {
+	server, ok := runner.(*hg.CommandServer)
+	if !ok {
+		return
+	}
+	err := server.Close()
+	if err != nil {
+		fmt.Fprintf(errWriter, "Error stopping hg command server: %s\n", err)
+	}
+}
+
+// Adds the likely cause to errors of hg commands that failed to talk to the
+// remote repository, which otherwise only show an exit status.
+func explainError(err error) error {
+	var authenticationError *hg.AuthenticationError
+	var fingerprintMismatchError *hg.FingerprintMismatchError
+	var hostKeyError *hg.HostKeyError
+	var tlsError *hg.TlsError
+	var hostUnreachableError *hg.HostUnreachableError
+	switch {
+	case errors.As(err, &fingerprintMismatchError):
+		return fmt.Errorf("%s\nThe certificate of %s does not match host_fingerprints. If it was renewed, update host_fingerprints, otherwise the connection may have been intercepted", err, fingerprintMismatchError.Host)
+	case errors.As(err, &hostKeyError):
+		return fmt.Errorf("%s\nThe host key of the repository is not in known_hosts, or does not match it. If it was changed, update known_hosts, otherwise the connection may have been intercepted", err)
+	case errors.As(err, &authenticationError):
+		return fmt.Errorf("%s\nThe repository refused the credentials, check the uri, and username, password or token for http(s) uris or private_key for ssh uris", err)
+	case errors.As(err, &tlsError):
+		return fmt.Errorf("%s\nThe TLS connection to the repository failed, check its certificate", err)
+	case errors.As(err, &hostUnreachableError):
+		return fmt.Errorf("%s\nThe repository could not be reached, check the uri and the network", err)
 	}
+	return err
 }
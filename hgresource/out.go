@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
-	"strings"
 	"time"
 
 	"github.com/concourse/hg-resource/hg"
@@ -22,11 +23,13 @@ var cmdOut = &Command{
 }
 
 type PushParams struct {
-	Branch     string
-	SourcePath string
-	DestUri    string
-	TagValue   string
-	Rebase     bool
+	Branch      string
+	Bookmark    string
+	MultiBranch bool
+	SourcePath  string
+	DestUri     string
+	TagValue    string
+	Rebase      bool
 }
 
 const maxRebaseRetries = 10
@@ -43,36 +46,106 @@ func runOut(args []string, input *JsonInput, outWriter io.Writer, errWriter io.W
 	sourceRepo := &hg.Repository{
 		Path:                validatedParams.SourcePath,
 		Branch:              validatedParams.Branch,
+		Bookmark:            validatedParams.Bookmark,
 		SkipSslVerification: input.Source.SkipSslVerification,
+		Timestamps:          input.Source.LogTimestamps,
 	}
 
-	commitId, err := sourceRepo.GetCurrentCommitId()
+	sourceRepo.Timeout, sourceRepo.NetworkTimeout, err = parseTimeouts(&input.Source)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	sourceRepo.Retries, sourceRepo.RetryBackoff, err = parseRetries(&input.Source)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+	sourceRepo.Stderr = errWriter
+
+	certFiles, err := writeTlsFiles(&input.Source)
+	defer certFiles.Remove()
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+	if certFiles != nil {
+		sourceRepo.CaCertsFile = certFiles.CaCerts
+	}
+
+	sourceRepo.HttpAuth, err = makeHttpAuth(&input.Source, certFiles)
+	defer sourceRepo.HttpAuth.Remove()
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	sourceRepo.HostFingerprints, err = makeHostFingerprints(&input.Source)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+
+	sshConf, err := setUpSsh(&input.Source)
+	defer sshConf.Close()
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+	sourceRepo.SshCommand = sshConf.Command
+
+	runner, err := startRunner(&input.Source, sourceRepo.HttpAuth)
+	defer stopRunner(runner, errWriter)
+	if err != nil {
+		fmt.Fprintln(errWriter, err)
+		return 1
+	}
+	sourceRepo.Runner = runner
+	ctx := context.Background()
+
+	// a source following several branches pushes to the branch of the
+	// checked-out commit
+	if validatedParams.MultiBranch {
+		validatedParams.Branch, err = sourceRepo.GetCurrentBranch(ctx)
+		if err != nil {
+			fmt.Fprintln(errWriter, err)
+			return 1
+		}
+		sourceRepo.Branch = validatedParams.Branch
+	}
+
+	commitId, err := sourceRepo.GetCurrentCommitId(ctx)
 	if err != nil {
 		fmt.Fprintln(errWriter, err)
 		return 1
 	}
 
 	// clone source into temporary directory, up to the current (not latest) commit id, thus truncating history
-	tempRepo, tempRepoCleanup, err := cloneAtCommitIntoTempDir(sourceRepo, commitId, errWriter)
+	tempRepo, tempRepoCleanup, err := cloneAtCommitIntoTempDir(ctx, sourceRepo, commitId, errWriter)
 	defer tempRepoCleanup(errWriter)
 
 	var jsonOutput JsonOutput
 	if validatedParams.Rebase {
-		jsonOutput, err = rebaseAndPush(tempRepo, validatedParams, maxRebaseRetries, errWriter)
+		jsonOutput, err = rebaseAndPush(ctx, tempRepo, validatedParams, maxRebaseRetries, errWriter)
 		if err != nil {
 			fmt.Fprintln(errWriter, err)
 			return 1
 		}
 
 	} else {
-		output, err := tempRepo.Push(validatedParams.DestUri, validatedParams.Branch)
-		errWriter.Write(output)
+		err = pushToDest(ctx, tempRepo, validatedParams)
+		var nonFastForwardError *hg.NonFastForwardError
+		if errors.As(err, &nonFastForwardError) {
+			fmt.Fprintf(errWriter, "%s\nThe destination has new commits, set rebase to rebase onto them before pushing\n", err)
+			return 1
+		}
 		if err != nil {
-			fmt.Fprintln(errWriter, err)
+			fmt.Fprintln(errWriter, explainError(err))
 			return 1
 		}
 
-		jsonOutput, err = getJsonOutputForCurrentCommit(tempRepo)
+		jsonOutput, err = getJsonOutputForCurrentCommit(ctx, tempRepo, validatedParams.MultiBranch)
 		if err != nil {
 			fmt.Fprintf(errWriter, "Error retrieving metadata from temp repository: %s", err)
 			return 1
@@ -83,24 +156,27 @@ func runOut(args []string, input *JsonInput, outWriter io.Writer, errWriter io.W
 	return 0
 }
 
-func rebaseAndPush(tempRepo *hg.Repository, params PushParams, maxRetries int, errWriter io.Writer) (jsonOutput JsonOutput, err error) {
+func rebaseAndPush(ctx context.Context, tempRepo *hg.Repository, params PushParams, maxRetries int, errWriter io.Writer) (jsonOutput JsonOutput, err error) {
 	for pushAttempt := 0; pushAttempt < maxRetries; pushAttempt++ {
-		var output []byte
 		fmt.Fprintf(errWriter, "rebasing, attempt %d/%d...\n", pushAttempt+1, maxRetries)
-		output, err = tempRepo.PullWithRebase(params.DestUri, params.Branch)
-		errWriter.Write(output)
+		err = pullWithRebase(ctx, tempRepo, params)
+		var mergeConflictError *hg.MergeConflictError
+		if errors.As(err, &mergeConflictError) {
+			err = fmt.Errorf("%s\nRebasing onto %s failed with conflicts, they have to be resolved manually", err, hg.RedactUri(params.DestUri))
+			return
+		}
 		if err != nil {
+			err = explainError(err)
 			return
 		}
 
-		jsonOutput, err = getJsonOutputForCurrentCommit(tempRepo)
+		jsonOutput, err = getJsonOutputForCurrentCommit(ctx, tempRepo, params.MultiBranch)
 		if err != nil {
 			return
 		}
 
 		if len(params.TagValue) > 0 {
-			output, err = tempRepo.Tag(params.TagValue)
-			errWriter.Write(output)
+			err = tempRepo.Tag(ctx, params.TagValue)
 			if err != nil {
 				return
 			}
@@ -110,14 +186,15 @@ func rebaseAndPush(tempRepo *hg.Repository, params PushParams, maxRetries int, e
 			time.Sleep(2 * time.Second)
 		}
 
-		output, err = tempRepo.Push(params.DestUri, params.Branch)
-		errWriter.Write(output)
+		err = pushToDest(ctx, tempRepo, params)
 		if err == nil {
 			fmt.Fprintln(errWriter, "pushed")
 			return
 		}
-		if !isNonFastForwardError(string(output)) {
+		var nonFastForwardError *hg.NonFastForwardError
+		if !errors.As(err, &nonFastForwardError) {
 			fmt.Fprintln(errWriter, "failed with non-rebase error")
+			err = explainError(err)
 			return
 		}
 	}
@@ -125,16 +202,32 @@ func rebaseAndPush(tempRepo *hg.Repository, params PushParams, maxRetries int, e
 	return
 }
 
-func getJsonOutputForCurrentCommit(repo *hg.Repository) (output JsonOutput, err error) {
+// In bookmark mode, the bookmark is advanced to the pushed changeset instead
+// of pushing the branch.
+func pushToDest(ctx context.Context, repo *hg.Repository, params PushParams) error {
+	if len(params.Bookmark) > 0 {
+		return repo.PushBookmark(ctx, params.DestUri, params.Bookmark)
+	}
+	return repo.Push(ctx, params.DestUri, params.Branch)
+}
+
+func pullWithRebase(ctx context.Context, repo *hg.Repository, params PushParams) error {
+	if len(params.Bookmark) > 0 {
+		return repo.PullBookmarkWithRebase(ctx, params.DestUri, params.Bookmark)
+	}
+	return repo.PullWithRebase(ctx, params.DestUri, params.Branch)
+}
+
+func getJsonOutputForCurrentCommit(ctx context.Context, repo *hg.Repository, withBranch bool) (output JsonOutput, err error) {
 	var commitId string
-	commitId, err = repo.GetCurrentCommitId()
+	commitId, err = repo.GetCurrentCommitId(ctx)
 	if err != nil {
 		err = fmt.Errorf("Error getting rebased commit id from temp repo: %s", err)
 		return
 	}
 
 	var metadata []hg.CommitProperty
-	metadata, err = repo.Metadata(commitId)
+	metadata, err = repo.Metadata(ctx, commitId)
 	if err != nil {
 		err = fmt.Errorf("Error getting metadata from rebased commit in temp repo: %s", err)
 		return
@@ -146,20 +239,14 @@ func getJsonOutputForCurrentCommit(repo *hg.Repository) (output JsonOutput, err
 		},
 		Metadata: metadata,
 	}
-	return
-}
 
-func isNonFastForwardError(hgStderr string) bool {
-	lines := strings.Split(hgStderr, "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, "abort: push creates new remote head") {
-			return true
-		}
+	if withBranch {
+		output.Version.Branch, err = repo.GetCurrentBranch(ctx)
 	}
-	return false
+	return
 }
 
-func cloneAtCommitIntoTempDir(sourceRepo *hg.Repository, commitId string, errWriter io.Writer) (tempRepo *hg.Repository, cleanupFunc func(io.Writer), err error) {
+func cloneAtCommitIntoTempDir(ctx context.Context, sourceRepo *hg.Repository, commitId string, errWriter io.Writer) (tempRepo *hg.Repository, cleanupFunc func(io.Writer), err error) {
 	tempRepoDir, err := getTempDirForCommit(commitId)
 	if err != nil {
 		return
@@ -167,7 +254,19 @@ func cloneAtCommitIntoTempDir(sourceRepo *hg.Repository, commitId string, errWri
 	tempRepo = &hg.Repository{
 		Path:                tempRepoDir,
 		Branch:              sourceRepo.Branch,
+		Bookmark:            sourceRepo.Bookmark,
 		SkipSslVerification: sourceRepo.SkipSslVerification,
+		Runner:              sourceRepo.Runner,
+		Timeout:             sourceRepo.Timeout,
+		NetworkTimeout:      sourceRepo.NetworkTimeout,
+		Retries:             sourceRepo.Retries,
+		RetryBackoff:        sourceRepo.RetryBackoff,
+		Stderr:              sourceRepo.Stderr,
+		Timestamps:          sourceRepo.Timestamps,
+		HttpAuth:            sourceRepo.HttpAuth,
+		CaCertsFile:         sourceRepo.CaCertsFile,
+		HostFingerprints:    sourceRepo.HostFingerprints,
+		SshCommand:          sourceRepo.SshCommand,
 	}
 	cleanupFunc = func(errWriter io.Writer) {
 		envOverride := os.Getenv("TEST_REPO_AT_REF_DIR")
@@ -179,14 +278,12 @@ func cloneAtCommitIntoTempDir(sourceRepo *hg.Repository, commitId string, errWri
 		}
 	}
 
-	output, err := tempRepo.CloneAtCommit(sourceRepo.Path, commitId)
-	errWriter.Write(output)
+	err = tempRepo.CloneAtCommit(ctx, sourceRepo.Path, commitId)
 	if err != nil {
 		return
 	}
 
-	output, err = tempRepo.SetDraftPhase()
-	errWriter.Write(output)
+	err = tempRepo.SetDraftPhase(ctx)
 	if err != nil {
 		return
 	}
@@ -211,6 +308,8 @@ func validateInput(input *JsonInput, sourceDir string) (validated PushParams, er
 	if len(validated.Branch) == 0 {
 		validated.Branch = defaultBranch
 	}
+	validated.Bookmark = input.Source.Bookmark
+	validated.MultiBranch = len(input.Source.Branches) > 0
 	validated.SourcePath = path.Join(sourceDir, input.Params.Repository)
 
 	if len(input.Params.Tag) > 0 {
@@ -2,202 +2,425 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
-	"encoding/base32"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"github.com/concourse/hg-resource/hg"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
-	"os/exec"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	tempDirEnv                  = "TMPDIR"
-	defaultTempDir              = "/tmp"
-	keyFileName                 = "hg-resource-private-key"
-	sshAskpassPath              = "/opt/resource/askpass.sh"
-	sshClientConfig             = "StrictHostKeyChecking no\nLogLevel quiet\n"
-	sshClientConfigFileRelative = ".ssh/config"
+	tempDirEnv     = "TMPDIR"
+	defaultTempDir = "/tmp"
 )
 
-// Writes SSH private key to a file in $TMPDIR or /tmp, starts ssh-agent and
-// loads the key
-func loadSshPrivateKey(privateKeyPem string) error {
-	tempDir := getTempDir()
-	keyFilePath := path.Join(tempDir, keyFileName)
+// The command line hg runs ssh with, see `hg help config.ui.ssh`, the agent
+// that holds the private keys, and the directory of the files both refer to.
+type sshConfig struct {
+	dir     string
+	agent   *sshAgent
+	Command string
+}
 
-	err := atomicSave(keyFilePath, []byte(privateKeyPem), 0600, 0777)
+// Builds the ssh command line from the SSH options of the source. With
+// known_hosts, host keys are checked strictly against its entries, which are
+// written to a file only the resource can read. Without it, host keys are not
+// checked, as before the option existed. The private keys are served by an
+// agent in the resource, and never written to disk. Keys for particular hosts
+// are selected with an ssh_config file, see writeSshIdentities.
+//
+// The options are passed to ssh with each command, instead of being written
+// to ~/.ssh/config, and ssh uses the first value it gets for an option, so
+// ssh_options come first to take precedence.
+func setUpSsh(source *Source) (*sshConfig, error) {
+	err := validateSshOptions(source)
 	if err != nil {
-		return fmt.Errorf("Error writing private key to disk: %s", err)
+		return nil, err
 	}
-
-	err = startSshAgent()
+	identities, err := parseSshIdentities(source)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = addSshKey(keyFilePath)
-	if err != nil {
-		return err
+	args := []string{"ssh"}
+	for _, option := range source.SshOptions {
+		args = append(args, "-o", option)
+	}
+	if source.SshPort > 0 {
+		args = append(args, "-p", strconv.Itoa(source.SshPort))
+	}
+	if len(source.SshUser) > 0 {
+		args = append(args, "-l", source.SshUser)
 	}
 
-	homeDir, err := getHomeDir()
-	if err != nil {
-		return err
+	config := &sshConfig{}
+	if len(source.KnownHosts) > 0 || len(identities) > 0 {
+		config.dir, err = ioutil.TempDir(getTempDir(), "hg-resource-ssh-")
+		if err != nil {
+			return nil, fmt.Errorf("Error creating directory for SSH files: %s", err)
+		}
 	}
 
-	sshClientConfigFile := path.Join(homeDir, sshClientConfigFileRelative)
+	if len(source.KnownHosts) > 0 {
+		knownHostsFile := path.Join(config.dir, "known_hosts")
+		err = ioutil.WriteFile(knownHostsFile, []byte(source.KnownHosts), 0600)
+		if err != nil {
+			config.Close()
+			return nil, fmt.Errorf("Error writing known_hosts: %s", err)
+		}
+		args = append(args,
+			"-o", "StrictHostKeyChecking=yes",
+			"-o", "UserKnownHostsFile="+knownHostsFile,
+			"-o", "GlobalKnownHostsFile=/dev/null")
+	} else {
+		args = append(args,
+			"-o", "StrictHostKeyChecking=no",
+			"-o", "UserKnownHostsFile=/dev/null")
+	}
 
-	err = atomicSave(sshClientConfigFile, []byte(sshClientConfig), 0600, 0700)
-	if err != nil {
-		return err
+	if len(identities) > 0 {
+		socketPath := path.Join(config.dir, "agent.sock")
+		config.agent, err = startSshAgent(socketPath, identities)
+		if err != nil {
+			config.Close()
+			return nil, err
+		}
+		args = append(args, "-o", "IdentityAgent="+socketPath)
 	}
 
-	return nil
-}
+	if hasHostIdentities(identities) {
+		configFile, err := writeSshIdentities(config.dir, identities)
+		if err != nil {
+			config.Close()
+			return nil, err
+		}
+		// only the identities in the file are offered
+		args = append(args, "-F", configFile, "-o", "IdentitiesOnly=yes")
+	}
+
+	// hides the warnings about added host keys, but not errors
+	args = append(args, "-o", "LogLevel=ERROR")
 
-func getHomeDir() (string, error) {
-	homeDir := os.Getenv("HOME")
-	if len(homeDir) == 0 {
-		return "", fmt.Errorf("Unable to retrieve home directory from $HOME")
+	quotedArgs := make([]string, len(args))
+	for i, arg := range args {
+		quotedArgs[i] = hg.ShellQuote(arg)
 	}
-	return homeDir, nil
+	config.Command = strings.Join(quotedArgs, " ")
+	return config, nil
 }
 
-func addSshKey(keyFilePath string) error {
-	stderr := new(bytes.Buffer)
-	addCmd := exec.Command("ssh-add", keyFilePath)
-	addCmd.Env = append(addCmd.Env, os.Environ()...)
-	addCmd.Env = append(addCmd.Env, "DISPLAY=", "SSH_ASKPASS="+sshAskpassPath)
-	addCmd.Stderr = stderr
-	err := addCmd.Run()
-	if err != nil {
-		errMsg := stderr.String()
-		if len(errMsg) > 0 {
-			return fmt.Errorf("Error running ssh-add: %s", errMsg)
-		} else {
-			return fmt.Errorf("Error running ssh-add: %s", err)
+func validateSshOptions(source *Source) error {
+	var uri *url.URL
+	if hg.IsSshUri(source.Uri) {
+		uri, _ = url.Parse(source.Uri)
+	}
+
+	if source.SshPort < 0 || source.SshPort > 65535 {
+		return fmt.Errorf("Error: invalid ssh_port %d", source.SshPort)
+	}
+	if source.SshPort > 0 && uri != nil && len(uri.Port()) > 0 {
+		return fmt.Errorf("Error: ssh_port and the port in the uri must not be set together")
+	}
+	if strings.ContainsAny(source.SshUser, " \t\n@") {
+		return fmt.Errorf("Error: invalid ssh_user '%s'", source.SshUser)
+	}
+	if len(source.SshUser) > 0 && uri != nil && uri.User != nil {
+		return fmt.Errorf("Error: ssh_user and the user in the uri must not be set together")
+	}
+	for _, option := range source.SshOptions {
+		if len(option) == 0 || strings.HasPrefix(option, "-") || strings.Contains(option, "\n") {
+			return fmt.Errorf("Error: invalid ssh option '%s', expected an ssh_config option like ServerAliveInterval=30", option)
 		}
 	}
 
+	for i, line := range strings.Split(source.KnownHosts, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		// hosts, key type and key, optionally preceded by a marker like
+		// @cert-authority and followed by a comment
+		minFields := 3
+		if strings.HasPrefix(fields[0], "@") {
+			minFields = 4
+		}
+		if len(fields) < minFields {
+			return fmt.Errorf("Error: invalid line %d in known_hosts, expected host names, key type and key like in ~/.ssh/known_hosts", i+1)
+		}
+	}
 	return nil
 }
 
-func startSshAgent() error {
-	killSshAgent()
+// Stops the agent, which forgets the private keys, and deletes the files.
+func (config *sshConfig) Close() error {
+	if config == nil {
+		return nil
+	}
+	if config.agent != nil {
+		config.agent.Close()
+	}
+	if len(config.dir) == 0 {
+		return nil
+	}
+	return os.RemoveAll(config.dir)
+}
+
+// A private key, and optionally an OpenSSH certificate for it, which is
+// offered to the hosts matching host, a pattern like in ssh_config, or to
+// all hosts that no other identity is for, if host is empty.
+type sshIdentity struct {
+	host        string
+	key         interface{}
+	certificate *ssh.Certificate
+}
 
-	stdout := new(bytes.Buffer)
-	agentCmd := exec.Command("ssh-agent")
-	agentCmd.Stdout = stdout
+// Returns the identities of private_key, which may hold several keys, and
+// private_keys.
+func parseSshIdentities(source *Source) ([]sshIdentity, error) {
+	if len(source.PrivateKey) == 0 && len(source.PrivateKeys) == 0 {
+		if len(source.PrivateKeyPassphrase) > 0 {
+			return nil, fmt.Errorf("Error: private_key_passphrase requires private_key or private_keys")
+		}
+		return nil, nil
+	}
 
-	err := agentCmd.Run()
-	if err != nil {
-		return fmt.Errorf("Error running ssh-agent: %s", err)
+	var identities []sshIdentity
+	if len(source.PrivateKey) > 0 {
+		keys, err := parsePrivateKeys("private_key", source.PrivateKey, source.PrivateKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			identities = append(identities, sshIdentity{key: key})
+		}
 	}
 
-	setEnvironmentVariablesFromString(stdout.String())
-	return nil
+	for i, privateKey := range source.PrivateKeys {
+		if strings.ContainsAny(privateKey.Host, " \t\n\",!") {
+			return nil, fmt.Errorf("Error: invalid host '%s' in private_keys, expected a host name or a pattern like *.example.com", privateKey.Host)
+		}
+
+		keys, err := parsePrivateKeys(fmt.Sprintf("key %d in private_keys", i+1), privateKey.Key, source.PrivateKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(privateKey.Certificate) == 0 {
+			for _, key := range keys {
+				identities = append(identities, sshIdentity{host: privateKey.Host, key: key})
+			}
+			continue
+		}
+
+		if len(keys) > 1 {
+			return nil, fmt.Errorf("Error: key %d in private_keys has a certificate and must hold a single key", i+1)
+		}
+		certificate, err := parseCertificate(i+1, privateKey.Certificate, keys[0])
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, sshIdentity{host: privateKey.Host, key: keys[0], certificate: certificate})
+	}
+	return identities, nil
 }
 
-func killSshAgent() error {
-	pidString := os.Getenv("SSH_AGENT_PID")
-	if len(pidString) == 0 {
-		return nil
+// Returns the keys of all PEM blocks in privateKeyPem, in PKCS#1, PKCS#8,
+// SEC 1 or OpenSSH format. Encrypted keys are decrypted with passphrase.
+func parsePrivateKeys(name string, privateKeyPem string, passphrase string) ([]interface{}, error) {
+	var keys []interface{}
+	rest := []byte(privateKeyPem)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		key, err := parsePrivateKey(name, pem.EncodeToMemory(block), passphrase)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
 	}
 
-	pid, err := strconv.Atoi(pidString)
-	if err != nil {
-		return fmt.Errorf("Error killing ssh-agent: SSH_AGENT_PID not an integer, but: %s", pidString)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Error: %s does not contain a PEM encoded private key", name)
 	}
+	return keys, nil
+}
 
-	proc, err := os.FindProcess(pid)
+func parsePrivateKey(name string, pemBytes []byte, passphrase string) (interface{}, error) {
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	var passphraseMissingError *ssh.PassphraseMissingError
+	if errors.As(err, &passphraseMissingError) {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("Error: %s is protected by a passphrase, set private_key_passphrase", name)
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+		if err == x509.IncorrectPasswordError {
+			return nil, fmt.Errorf("Error: private_key_passphrase is incorrect for %s", name)
+		}
+	}
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Error parsing %s: %s", name, err)
 	}
+	return key, nil
+}
 
-	err = proc.Kill()
+// Parses an OpenSSH user certificate in the format of ssh-keygen -s, and
+// checks that it is for key and has not expired, as ssh would only report
+// that the server refused it.
+func parseCertificate(number int, certificate string, key interface{}) (*ssh.Certificate, error) {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(certificate))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Error parsing certificate %d in private_keys: %s", number, err)
+	}
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("Error: certificate %d in private_keys is not an OpenSSH user certificate", number)
 	}
 
-	return nil
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing key %d in private_keys: %s", number, err)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("Error: certificate %d in private_keys is not for its key", number)
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && time.Now().After(time.Unix(int64(cert.ValidBefore), 0)) {
+		return nil, fmt.Errorf("Error: certificate %d in private_keys expired at %s", number, time.Unix(int64(cert.ValidBefore), 0).UTC())
+	}
+	return cert, nil
 }
 
-func setEnvironmentVariablesFromString(multiLine string) {
-	lines := strings.Split(multiLine, "\n")
-	for _, line := range lines {
-		// we don't support any kind of quoting or escaping
-		lineBeforeSemicolon := strings.SplitN(line, ";", 2)
-		keyValue := strings.SplitN(lineBeforeSemicolon[0], "=", 2)
-		if len(keyValue) == 2 {
-			os.Setenv(keyValue[0], keyValue[1])
+func hasHostIdentities(identities []sshIdentity) bool {
+	for _, identity := range identities {
+		if len(identity.host) > 0 {
+			return true
 		}
 	}
+	return false
 }
 
-func atomicSave(filename string, content []byte, fileMode os.FileMode, dirMode os.FileMode) error {
-	dirName := path.Dir(filename)
-	_, pathErr := os.Stat(dirName)
-	if pathErr != nil {
-		err := os.MkdirAll(dirName, dirMode)
+// Writes the public keys and certificates of the identities, and an
+// ssh_config file that selects them by host, which replaces ~/.ssh/config
+// and /etc/ssh/ssh_config. Identities without a host are for the hosts that
+// no other identity is for. Returns the path of the ssh_config file.
+func writeSshIdentities(dir string, identities []sshIdentity) (string, error) {
+	var hosts []string
+	filesByHost := map[string][]string{}
+	for i, identity := range identities {
+		signer, err := ssh.NewSignerFromKey(identity.key)
 		if err != nil {
-			fmt.Errorf("atomicSave(): Error creating directory %s: %s", dirName, err)
+			return "", fmt.Errorf("Error writing SSH identities: %s", err)
 		}
 
-		// mkdir syscall typically doesn't set write flags for all/group
-		err = os.Chmod(dirName, dirMode)
+		keyFile := path.Join(dir, fmt.Sprintf("identity-%d.pub", i+1))
+		err = ioutil.WriteFile(keyFile, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600)
 		if err != nil {
-			fmt.Errorf("atomicSave(): %s", err)
+			return "", fmt.Errorf("Error writing SSH identities: %s", err)
+		}
+		lines := []string{fmt.Sprintf("  IdentityFile \"%s\"\n", keyFile)}
+
+		if identity.certificate != nil {
+			certificateFile := path.Join(dir, fmt.Sprintf("identity-%d-cert.pub", i+1))
+			err = ioutil.WriteFile(certificateFile, ssh.MarshalAuthorizedKey(identity.certificate), 0600)
+			if err != nil {
+				return "", fmt.Errorf("Error writing SSH identities: %s", err)
+			}
+			lines = append(lines, fmt.Sprintf("  CertificateFile \"%s\"\n", certificateFile))
 		}
-	}
 
-	tempFileName, err := makeTempFileName(filename)
-	if err != nil {
-		return err
+		if _, ok := filesByHost[identity.host]; !ok {
+			hosts = append(hosts, identity.host)
+		}
+		filesByHost[identity.host] = append(filesByHost[identity.host], lines...)
 	}
 
-	tempFile, err := os.Create(tempFileName)
-	if err != nil {
-		return fmt.Errorf("atomicSave(): %s", err)
+	// IdentityFile and CertificateFile add up over all matching Host
+	// sections, so the one for other hosts excludes the others
+	var config, otherHosts string
+	for _, host := range hosts {
+		if len(host) == 0 {
+			continue
+		}
+		config += "Host " + host + "\n" + strings.Join(filesByHost[host], "")
+		otherHosts += " !" + host
 	}
-
-	_, err = tempFile.Write(content)
-	if err != nil {
-		return fmt.Errorf("atomicSave(): Error writing to file %s: %s", tempFileName, err)
+	if defaultFiles, ok := filesByHost[""]; ok {
+		config += "Host *" + otherHosts + "\n" + strings.Join(defaultFiles, "")
 	}
 
-	err = tempFile.Sync()
-	if err != nil {
-		return err
-	}
-	err = tempFile.Close()
+	configFile := path.Join(dir, "ssh_config")
+	err := ioutil.WriteFile(configFile, []byte(config), 0600)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("Error writing ssh_config: %s", err)
 	}
+	return configFile, nil
+}
 
-	err = os.Chmod(tempFileName, fileMode)
-	if err != nil {
-		return fmt.Errorf("atomicSave(): Error changing permissions of %s: %s", tempFileName, err)
+// An SSH agent in the resource, which serves its private keys with the
+// agent protocol on a unix socket, like ssh-agent. The socket is in a
+// directory only the resource can access, and the keys are only kept in
+// memory.
+type sshAgent struct {
+	keyring  agent.Agent
+	listener net.Listener
+}
+
+// Serves each key, and each key with its certificate if it has one.
+func startSshAgent(socketPath string, identities []sshIdentity) (*sshAgent, error) {
+	keyring := agent.NewKeyring()
+	for _, identity := range identities {
+		err := keyring.Add(agent.AddedKey{PrivateKey: identity.key})
+		if err == nil && identity.certificate != nil {
+			err = keyring.Add(agent.AddedKey{PrivateKey: identity.key, Certificate: identity.certificate})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error adding private key to the SSH agent: %s", err)
+		}
 	}
 
-	err = os.Rename(tempFileName, filename)
+	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
-		return fmt.Errorf("Error renaming file %s to %s in atomicSave: %s", tempFileName, filename, err)
+		return nil, fmt.Errorf("Error starting the SSH agent: %s", err)
 	}
 
-	return nil
+	server := &sshAgent{keyring: keyring, listener: listener}
+	go server.serve()
+	return server, nil
 }
 
-func makeTempFileName(filename string) (string, error) {
-	randomBytes := make([]byte, 12)
-	_, err := rand.Read(randomBytes)
-	if err != nil {
-		return "", fmt.Errorf("Error creating temporary filename: %s", err)
+func (server *sshAgent) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			// the listener was closed
+			return
+		}
+		go func() {
+			defer conn.Close()
+			agent.ServeAgent(server.keyring, conn)
+		}()
 	}
+}
 
-	tempFileName := filename + "." + base32.StdEncoding.EncodeToString(randomBytes)
-	return tempFileName, nil
+// Removes the socket and the keys. Clients that are still connected get
+// no keys anymore.
+func (server *sshAgent) Close() error {
+	err := server.listener.Close()
+	server.keyring.RemoveAll()
+	return err
 }
 
 func getTempDir() string {
@@ -1,73 +1,63 @@
 package main
 
 import (
-	. "github.com/onsi/ginkgo"
-	. "github.com/onsi/gomega"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/exec"
 	"path"
-	"strconv"
-	"syscall"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
-func processExists(pid int) bool {
-	proc, _ := os.FindProcess(pid)
-	err := proc.Signal(syscall.Signal(0))
-	// err could also be "permission denied", but for this test it's good enough
-	return err == nil
+// Returns an ed25519 key in OpenSSH format, encrypted if passphrase is set,
+// and its public key.
+func makeTestEd25519Key(passphrase string) (string, ssh.PublicKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	Expect(err).To(BeNil())
+
+	var block *pem.Block
+	if len(passphrase) > 0 {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(privateKey, "test", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(privateKey, "test")
+	}
+	Expect(err).To(BeNil())
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	Expect(err).To(BeNil())
+	return string(pem.EncodeToMemory(block)), sshPublicKey
 }
 
-var _ = Describe("Ssh", func() {
-	Context("When starting ssh-agent", func() {
-		vars := "SSH_AGENT_PID=123; export SSH_AGENT_PID;\nFOO=bar; export FOO;\nANSWER=42\n"
-		BeforeEach(func() {
-			os.Setenv("SSH_AGENT_PID", "")
-			os.Setenv("FOO", "")
-			os.Setenv("ANSWER", "")
-		})
-
-		It("sets the environment variables ssh-agent prints to STDOUT", func() {
-			setEnvironmentVariablesFromString(vars)
-
-			Expect(os.Getenv("SSH_AGENT_PID")).To(Equal("123"))
-			Expect(os.Getenv("FOO")).To(Equal("bar"))
-			Expect(os.Getenv("ANSWER")).To(Equal("42"))
-		})
-
-		It("can start and kill the agent", func() {
-			err := startSshAgent()
-			Expect(err).To(BeNil())
-
-			Expect(os.Getenv("SSH_AGENT_PID")).ToNot(BeEmpty())
-
-			pid, err := strconv.Atoi(os.Getenv("SSH_AGENT_PID"))
-			Expect(err).To(BeNil())
-
-			err = killSshAgent()
-			Expect(err).To(BeNil())
-
-			Eventually(func() bool {
-				return processExists(pid)
-			}).Should(BeFalse())
-		})
-	})
-
-	Context("When creating a temp filename", func() {
-		baseFileName := "/tmp/hg-resource-test-base-filename"
-		var tempFileName string
-		var err error
-
-		BeforeEach(func() {
-			tempFileName, err = makeTempFileName(baseFileName)
-		})
-
-		It("appends random characters to the base filename", func() {
-			Expect(err).To(BeNil())
-			Expect(tempFileName).To(HavePrefix(baseFileName + "."))
-			Expect(len(tempFileName)).To(BeNumerically(">", len(baseFileName)))
-		})
-	})
+// Returns an OpenSSH certificate for publicKey, signed by a new CA.
+func makeTestUserCertificate(publicKey ssh.PublicKey, certType uint32, validBefore uint64) string {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	Expect(err).To(BeNil())
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	Expect(err).To(BeNil())
+
+	certificate := &ssh.Certificate{
+		Key:             publicKey,
+		CertType:        certType,
+		KeyId:           "test",
+		ValidPrincipals: []string{"hg"},
+		ValidBefore:     validBefore,
+	}
+	Expect(certificate.SignCert(rand.Reader, caSigner)).To(Succeed())
+	return string(ssh.MarshalAuthorizedKey(certificate))
+}
 
+var _ = Describe("Ssh", func() {
 	Context("When asking for the temp directory", func() {
 		Context("if $TMPDIR is set", func() {
 			BeforeEach(func() {
@@ -95,94 +85,231 @@ var _ = Describe("Ssh", func() {
 
 	})
 
-	Context("When saving the SSH private key and the SSH config file", func() {
-		var previousHome string
+	Context("When building the ssh command line", func() {
+		knownHosts := "# the main server\nhg.example.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBzB\n"
 
-		BeforeEach(func() {
-			previousHome = os.Getenv("HOME")
-			os.Setenv("HOME", "/some/home/directory")
+		It("does not check host keys without known_hosts", func() {
+			config, err := setUpSsh(&Source{Uri: "ssh://example.com/repo"})
+			Expect(err).To(BeNil())
+			Expect(config.Command).To(Equal("ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o LogLevel=ERROR"))
+			Expect(config.Close()).To(Succeed())
 		})
 
-		It("can find the users home directory", func() {
-			homeDir, err := getHomeDir()
+		It("checks host keys strictly against known_hosts", func() {
+			config, err := setUpSsh(&Source{Uri: "ssh://example.com/repo", KnownHosts: knownHosts})
+			Expect(err).To(BeNil())
+			defer config.Close()
+
+			knownHostsFile := path.Join(config.dir, "known_hosts")
+			Expect(config.Command).To(Equal("ssh -o StrictHostKeyChecking=yes -o UserKnownHostsFile=" + knownHostsFile + " -o GlobalKnownHostsFile=/dev/null -o LogLevel=ERROR"))
 
+			content, err := ioutil.ReadFile(knownHostsFile)
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal(knownHosts))
+			fileInfo, err := os.Stat(knownHostsFile)
+			Expect(err).To(BeNil())
+			Expect(fileInfo.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+			Expect(config.Close()).To(Succeed())
+			_, err = os.Stat(config.dir)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("passes the port, user and options, quoted for the shell", func() {
+			config, err := setUpSsh(&Source{
+				Uri:        "ssh://example.com/repo",
+				SshPort:    2222,
+				SshUser:    "hg",
+				SshOptions: []string{"ServerAliveInterval=30", "ProxyCommand ssh -W %h:%p bastion"},
+			})
 			Expect(err).To(BeNil())
-			Expect(homeDir).To(Equal("/some/home/directory"))
+			Expect(config.Command).To(HavePrefix("ssh -o ServerAliveInterval=30 -o 'ProxyCommand ssh -W %h:%p bastion' -p 2222 -l hg -o StrictHostKeyChecking=no"))
 		})
 
-		AfterEach(func() {
-			os.Setenv("HOME", previousHome)
+		It("rejects invalid options", func() {
+			for _, source := range []Source{
+				{Uri: "ssh://example.com/repo", SshPort: 70000},
+				{Uri: "ssh://example.com:2222/repo", SshPort: 22},
+				{Uri: "ssh://jdoe@example.com/repo", SshUser: "hg"},
+				{Uri: "ssh://example.com/repo", SshUser: "h g"},
+				{Uri: "ssh://example.com/repo", SshOptions: []string{"-F /dev/null"}},
+				{Uri: "ssh://example.com/repo", KnownHosts: "hg.example.com ssh-ed25519\n"},
+				{Uri: "ssh://example.com/repo", KnownHosts: "@cert-authority *.example.com ssh-ed25519\n"},
+			} {
+				config, err := setUpSsh(&source)
+				Expect(err).ToNot(BeNil())
+				Expect(config).To(BeNil())
+			}
 		})
 	})
 
-	Context("When saving a file atomically", func() {
-		var dirname string
-		var filename string
-		content := "hello test runner\n"
-		var direrr error
-		var err error
+	Context("When loading private keys", func() {
+		It("parses several keys, decrypting them with the passphrase", func() {
+			ed25519Pem, ed25519PublicKey := makeTestEd25519Key("a passphrase")
 
-		BeforeEach(func() {
-			dirname, direrr = makeTempFileName("/tmp/hg-resource-test/test-run")
-			filename = path.Join(dirname, "base-filename")
+			ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).To(BeNil())
+			ecdsaDer, err := x509.MarshalECPrivateKey(ecdsaKey)
+			Expect(err).To(BeNil())
+			ecdsaPem := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecdsaDer}))
+
+			keys, err := parsePrivateKeys("private_key", ed25519Pem+ecdsaPem, "a passphrase")
+			Expect(err).To(BeNil())
+			Expect(keys).To(HaveLen(2))
+
+			signer, err := ssh.NewSignerFromKey(keys[0])
+			Expect(err).To(BeNil())
+			Expect(signer.PublicKey().Marshal()).To(Equal(ed25519PublicKey.Marshal()))
 		})
 
-		JustBeforeEach(func() {
-			err = atomicSave(filename, []byte(content), 0600, 0707)
+		It("requires the right passphrase for encrypted keys", func() {
+			keyPem, _ := makeTestEd25519Key("a passphrase")
+
+			_, err := parsePrivateKeys("private_key", keyPem, "")
+			Expect(err).To(MatchError("Error: private_key is protected by a passphrase, set private_key_passphrase"))
+
+			_, err = parsePrivateKeys("private_key", keyPem, "another passphrase")
+			Expect(err).To(MatchError("Error: private_key_passphrase is incorrect for private_key"))
 		})
 
-		AfterEach(func() {
-			os.RemoveAll(dirname)
+		It("rejects anything else", func() {
+			_, err := parsePrivateKeys("private_key", "xyz", "")
+			Expect(err).To(MatchError("Error: private_key does not contain a PEM encoded private key"))
+
+			_, err = parseSshIdentities(&Source{PrivateKeyPassphrase: "a passphrase"})
+			Expect(err).To(MatchError("Error: private_key_passphrase requires private_key or private_keys"))
 		})
 
-		Context("if the directory does not exist yet", func() {
-			It("creates the directory structure", func() {
-				Expect(direrr).To(BeNil())
-				Expect(err).To(BeNil())
+		It("serves the keys with an agent until it is closed", func() {
+			keyPem, publicKey := makeTestEd25519Key("")
 
-				dirInfo, statErr := os.Stat(dirname)
-				Expect(statErr).To(BeNil())
-				Expect(dirInfo.IsDir()).To(BeTrue())
-			})
+			config, err := setUpSsh(&Source{Uri: "ssh://example.com/repo", PrivateKey: keyPem})
+			Expect(err).To(BeNil())
+			defer config.Close()
 
-			It("sets the file and directory permissions", func() {
-				Expect(direrr).To(BeNil())
-				Expect(err).To(BeNil())
+			socketPath := path.Join(config.dir, "agent.sock")
+			Expect(config.Command).To(ContainSubstring(" -o IdentityAgent=" + socketPath + " "))
+			socketInfo, err := os.Stat(config.dir)
+			Expect(err).To(BeNil())
+			Expect(socketInfo.Mode().Perm()).To(Equal(os.FileMode(0700)))
 
-				dirInfo, statErr := os.Stat(dirname)
-				Expect(statErr).To(BeNil())
-				Expect(dirInfo.Mode().Perm()).To(Equal(os.FileMode(0707)))
+			conn, err := net.Dial("unix", socketPath)
+			Expect(err).To(BeNil())
+			defer conn.Close()
+			client := agent.NewClient(conn)
 
-				fileInfo, statErr := os.Stat(filename)
-				Expect(statErr).To(BeNil())
-				Expect(fileInfo.Mode().Perm()).To(Equal(os.FileMode(0600)))
-			})
+			keys, err := client.List()
+			Expect(err).To(BeNil())
+			Expect(keys).To(HaveLen(1))
+			Expect(keys[0].Blob).To(Equal(publicKey.Marshal()))
 
-			It("writes the expected content", func() {
-				actualContent, readErr := ioutil.ReadFile(filename)
-				Expect(readErr).To(BeNil())
-				Expect(string(actualContent)).To(Equal(content))
-			})
+			signature, err := client.Sign(publicKey, []byte("data"))
+			Expect(err).To(BeNil())
+			Expect(publicKey.Verify([]byte("data"), signature)).To(Succeed())
+
+			Expect(config.Close()).To(Succeed())
+			keys, err = client.List()
+			Expect(err).To(BeNil())
+			Expect(keys).To(BeEmpty())
+			_, err = os.Stat(config.dir)
+			Expect(os.IsNotExist(err)).To(BeTrue())
 		})
+	})
 
-		Context("if the parent directory already exists", func() {
-			var preCreateDirErr error
-			BeforeEach(func() {
-				preCreateDirErr = os.MkdirAll(dirname, 0770)
-				os.Chmod(dirname, 0770)
+	Context("When selecting keys by host", func() {
+		It("serves certificates along with their keys", func() {
+			keyPem, publicKey := makeTestEd25519Key("")
+			certificate := makeTestUserCertificate(publicKey, ssh.UserCert, ssh.CertTimeInfinity)
+
+			config, err := setUpSsh(&Source{
+				Uri:         "ssh://hg.example.com/repo",
+				PrivateKeys: []PrivateKey{{Host: "hg.example.com", Key: keyPem, Certificate: certificate}},
 			})
+			Expect(err).To(BeNil())
+			defer config.Close()
+
+			conn, err := net.Dial("unix", path.Join(config.dir, "agent.sock"))
+			Expect(err).To(BeNil())
+			defer conn.Close()
+			keys, err := agent.NewClient(conn).List()
+			Expect(err).To(BeNil())
+			Expect(keys).To(HaveLen(2))
+			Expect(keys[0].Blob).To(Equal(publicKey.Marshal()))
+			Expect(keys[1].Format).To(Equal(ssh.CertAlgoED25519v01))
 
-			It("does not change directory permissions if the directories exist already", func() {
-				Expect(preCreateDirErr).To(BeNil())
-				Expect(direrr).To(BeNil())
+			Expect(config.Command).To(ContainSubstring(" -F " + path.Join(config.dir, "ssh_config") + " -o IdentitiesOnly=yes "))
+			content, err := ioutil.ReadFile(path.Join(config.dir, "identity-1-cert.pub"))
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal(certificate))
+		})
 
-				dirInfo, statErr := os.Stat(dirname)
-				Expect(statErr).To(BeNil())
-				Expect(dirInfo.Mode().Perm()).To(Equal(os.FileMode(0770)))
+		It("rejects certificates that do not fit", func() {
+			keyPem, publicKey := makeTestEd25519Key("")
+			otherKeyPem, otherPublicKey := makeTestEd25519Key("")
+
+			for _, privateKey := range []PrivateKey{
+				{Key: keyPem, Certificate: "xyz"},
+				{Key: keyPem, Certificate: string(ssh.MarshalAuthorizedKey(publicKey))},
+				{Key: keyPem, Certificate: makeTestUserCertificate(otherPublicKey, ssh.UserCert, ssh.CertTimeInfinity)},
+				{Key: keyPem, Certificate: makeTestUserCertificate(publicKey, ssh.HostCert, ssh.CertTimeInfinity)},
+				{Key: keyPem, Certificate: makeTestUserCertificate(publicKey, ssh.UserCert, 1)},
+				{Key: keyPem + otherKeyPem, Certificate: makeTestUserCertificate(publicKey, ssh.UserCert, ssh.CertTimeInfinity)},
+				{Host: "a.example.com,b.example.com", Key: keyPem},
+			} {
+				_, err := parseSshIdentities(&Source{PrivateKeys: []PrivateKey{privateKey}})
+				Expect(err).ToNot(BeNil())
+			}
+
+			_, err := parseSshIdentities(&Source{PrivateKeys: []PrivateKey{{Key: keyPem, Certificate: makeTestUserCertificate(otherPublicKey, ssh.UserCert, ssh.CertTimeInfinity)}}})
+			Expect(err).To(MatchError("Error: certificate 1 in private_keys is not for its key"))
+		})
 
-				Expect(err).To(BeNil())
+		It("offers each host its identities, and the others to all other hosts", func() {
+			keyPem, _ := makeTestEd25519Key("")
+			otherKeyPem, otherPublicKey := makeTestEd25519Key("")
+			certificate := makeTestUserCertificate(otherPublicKey, ssh.UserCert, ssh.CertTimeInfinity)
+
+			config, err := setUpSsh(&Source{
+				Uri:        "ssh://hg.example.com/repo",
+				PrivateKey: keyPem,
+				PrivateKeys: []PrivateKey{
+					{Host: "hg.example.com", Key: otherKeyPem, Certificate: certificate},
+					{Host: "*.subrepos.example.com", Key: keyPem},
+				},
 			})
+			Expect(err).To(BeNil())
+			defer config.Close()
+
+			configFile := path.Join(config.dir, "ssh_config")
+			content, err := ioutil.ReadFile(configFile)
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal(strings.Replace(`Host hg.example.com
+  IdentityFile "DIR/identity-2.pub"
+  CertificateFile "DIR/identity-2-cert.pub"
+Host *.subrepos.example.com
+  IdentityFile "DIR/identity-3.pub"
+Host * !hg.example.com !*.subrepos.example.com
+  IdentityFile "DIR/identity-1.pub"
+`, "DIR", config.dir, -1)))
+
+			_, err = exec.LookPath("ssh")
+			if err != nil {
+				Skip("ssh is not installed")
+			}
+			sshIdentities := func(host string) []string {
+				output, err := exec.Command("ssh", "-G", "-F", configFile, host).Output()
+				Expect(err).To(BeNil())
+				var identities []string
+				for _, line := range strings.Split(string(output), "\n") {
+					if strings.HasPrefix(line, "identityfile ") || strings.HasPrefix(line, "certificatefile ") {
+						identities = append(identities, path.Base(strings.Fields(line)[1]))
+					}
+				}
+				return identities
+			}
+			Expect(sshIdentities("hg.example.com")).To(Equal([]string{"identity-2.pub", "identity-2-cert.pub"}))
+			Expect(sshIdentities("a.subrepos.example.com")).To(Equal([]string{"identity-3.pub"}))
+			Expect(sshIdentities("other.example.com")).To(Equal([]string{"identity-1.pub"}))
 		})
 	})
-
 })
@@ -9,18 +9,99 @@ import (
 )
 
 type Source struct {
-	Uri                 string   `json:"uri"`
-	PrivateKey          string   `json:"private_key"`
-	IncludePaths        []string `json:"paths"`
-	ExcludePaths        []string `json:"ignore_paths"`
-	Branch              string   `json:"branch"`
-	TagFilter           string   `json:"tag_filter"`
-	RevSetFilter        string   `json:"revset_filter"`
-	SkipSslVerification bool     `json:"skip_ssl_verification"`
+	Uri                  string                  `json:"uri"`
+	PrivateKey           string                  `json:"private_key"`
+	PrivateKeys          []PrivateKey            `json:"private_keys"`
+	PrivateKeyPassphrase string                  `json:"private_key_passphrase"`
+	Username             string                  `json:"username"`
+	Password             string                  `json:"password"`
+	Token                string                  `json:"token"`
+	CaCert               string                  `json:"ca_cert"`
+	ClientCert           string                  `json:"client_cert"`
+	ClientKey            string                  `json:"client_key"`
+	HostFingerprints     map[string]Fingerprints `json:"host_fingerprints"`
+	KnownHosts           string                  `json:"known_hosts"`
+	SshPort              int                     `json:"ssh_port"`
+	SshUser              string                  `json:"ssh_user"`
+	SshOptions           []string                `json:"ssh_options"`
+	IncludePaths         []string                `json:"paths"`
+	ExcludePaths         []string                `json:"ignore_paths"`
+	Authors              []string                `json:"authors"`
+	IgnoreAuthors        []string                `json:"ignore_authors"`
+	Merges               string                  `json:"merges"`
+	Branch               string                  `json:"branch"`
+	Bookmark             string                  `json:"bookmark"`
+	Branches             Branches                `json:"branches"`
+	TagFilter            string                  `json:"tag_filter"`
+	RevSetFilter         string                  `json:"revset_filter"`
+	InitialRef           string                  `json:"initial_ref"`
+	SinceDate            string                  `json:"since_date"`
+	Phases               []string                `json:"phases"`
+	SkipCiPatterns       []string                `json:"skip_ci_patterns"`
+	DisableCiSkip        bool                    `json:"disable_ci_skip"`
+	Evolution            bool                    `json:"evolution"`
+	SkipSslVerification  bool                    `json:"skip_ssl_verification"`
+	CommandServer        bool                    `json:"command_server"`
+	Timeout              string                  `json:"timeout"`
+	NetworkTimeout       string                  `json:"network_timeout"`
+	Retries              int                     `json:"retries"`
+	RetryBackoff         string                  `json:"retry_backoff"`
+	LogTimestamps        bool                    `json:"log_timestamps"`
+}
+
+// An SSH private key and optionally an OpenSSH certificate for it, for the
+// hosts matching Host, or for all other hosts if it is empty.
+type PrivateKey struct {
+	Host        string `json:"host"`
+	Key         string `json:"key"`
+	Certificate string `json:"certificate"`
 }
 
 type Version struct {
-	Ref string `json:"ref"`
+	Ref    string `json:"ref"`
+	Branch string `json:"branch,omitempty"`
+}
+
+// A list of branch names or patterns in Mercurial's string matching syntax,
+// e.g. "re:^release/". A plain string is taken as a single regular expression.
+type Branches []string
+
+func (branches *Branches) UnmarshalJSON(data []byte) error {
+	var pattern string
+	err := json.Unmarshal(data, &pattern)
+	if err == nil {
+		*branches = Branches{"re:" + pattern}
+		return nil
+	}
+
+	var list []string
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return fmt.Errorf("branches must be a regular expression or a list of branches")
+	}
+	*branches = Branches(list)
+	return nil
+}
+
+// The sha256 fingerprints of the certificate of a host. A plain string is
+// taken as a single fingerprint.
+type Fingerprints []string
+
+func (fingerprints *Fingerprints) UnmarshalJSON(data []byte) error {
+	var fingerprint string
+	err := json.Unmarshal(data, &fingerprint)
+	if err == nil {
+		*fingerprints = Fingerprints{fingerprint}
+		return nil
+	}
+
+	var list []string
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return fmt.Errorf("host_fingerprints must map hosts to a fingerprint or a list of fingerprints")
+	}
+	*fingerprints = Fingerprints(list)
+	return nil
 }
 
 type Params struct {
@@ -48,7 +129,10 @@ func parseInput(inReader io.Reader) (*JsonInput, error) {
 	}
 
 	params := JsonInput{}
-	json.Unmarshal(bytes, &params)
+	err = json.Unmarshal(bytes, &params)
+	if err != nil {
+		return nil, err
+	}
 	return &params, nil
 }
 
@@ -134,6 +134,42 @@ make_commit() {
   make_commit_to_file $1 some-file
 }
 
+make_commit_to_bookmark() {
+  local repo=$1
+  local bookmark=$2
+
+  if hg log --cwd $repo --rev "bookmark('$bookmark')" &>/dev/null; then
+    hg checkout -q --cwd $repo $bookmark
+  else
+    # make sure we bookmark from default
+    hg checkout -q --cwd $repo default
+    hg bookmark --cwd $repo $bookmark
+  fi
+
+  # modify file and commit, which moves the active bookmark
+  echo x >> $repo/some-file
+  hg commit --cwd $repo \
+    --config ui.username='test <test@example.com>' \
+    -q -m "commit on $bookmark"
+
+  # output resulting sha
+  hg log --cwd $repo --limit 1 --template "{node}"
+}
+
+make_merge() {
+  local repo=$1
+  local branch=$2
+
+  hg checkout -q --cwd $repo default
+  hg merge -q --cwd $repo $branch
+  hg commit --cwd $repo \
+    --config ui.username='test <test@example.com>' \
+    -q -m "merge $branch"
+
+  # output resulting sha
+  hg log --cwd $repo --limit 1 --template "{node}"
+}
+
 make_commit_after_1_second() {
   local repo=$1
   sleep 1
@@ -183,6 +219,10 @@ check_branch_exists() {
   hg log --cwd "$repo" --limit 1 --branch "$branch" &>/dev/null
 }
 
+get_cache_dir() {
+  ls -d $TMPDIR/hg-resource-repo-cache-* | head -n 1
+}
+
 check_uri() {
   jq -n "{
     source: {
@@ -218,6 +258,198 @@ check_uri_with_key() {
   }" | ${resource_dir}/check | tee /dev/stderr
 }
 
+check_uri_with_key_and_passphrase() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      private_key: $(cat $2 | jq -s -R .),
+      private_key_passphrase: $(echo $3 | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+
+check_uri_with_bookmark() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      bookmark: $(echo $2 | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_bookmark_from() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      bookmark: $(echo $3 | jq -R .)
+    },
+    version: {
+      ref: $(echo $2 | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_branches() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      branches: $(echo $2 | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_branches_from() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      branches: $(echo $4 | jq -R .)
+    },
+    version: {
+      ref: $(echo $2 | jq -R .),
+      branch: $(echo $3 | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_phases() {
+  local uri=$1
+
+  shift
+
+  jq -n "{
+    source: {
+      uri: $(echo $uri | jq -R .),
+      phases: $(echo "$@" | jq -R '. | split(" ")')
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_phases_from() {
+  local uri=$1
+  local ref=$2
+
+  shift 2
+
+  jq -n "{
+    source: {
+      uri: $(echo $uri | jq -R .),
+      phases: $(echo "$@" | jq -R '. | split(" ")')
+    },
+    version: {
+      ref: $(echo $ref | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_evolution() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      evolution: true
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_evolution_from() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      evolution: true
+    },
+    version: {
+      ref: $(echo $2 | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_skip_ci_patterns_from() {
+  local uri=$1
+  local ref=$2
+
+  shift 2
+
+  jq -n "{
+    source: {
+      uri: $(echo $uri | jq -R .),
+      skip_ci_patterns: \$ARGS.positional
+    },
+    version: {
+      ref: $(echo $ref | jq -R .)
+    }
+  }" --args "$@" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_ci_skip_disabled_from() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      disable_ci_skip: true
+    },
+    version: {
+      ref: $(echo $2 | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_authors_from() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      authors: [$(echo $3 | jq -R .)],
+      ignore_authors: [$(echo $4 | jq -R .)]
+    },
+    version: {
+      ref: $(echo $2 | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_initial_ref() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      initial_ref: $(echo $2 | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_since_date() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      since_date: $(echo $2 | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_merges_from_paths() {
+  local uri=$1
+  local ref=$2
+  local merges=$3
+
+  shift 3
+
+  jq -n "{
+    source: {
+      uri: $(echo $uri | jq -R .),
+      merges: $(echo $merges | jq -R .),
+      paths: \$ARGS.positional
+    },
+    version: {
+      ref: $(echo $ref | jq -R .)
+    }
+  }" --args "$@" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_ci_skip_disabled() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      disable_ci_skip: true
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
 
 check_uri_ignoring() {
   local uri=$1
@@ -402,6 +634,15 @@ get_uri() {
   }" | ${resource_dir}/in "$2" | tee /dev/stderr
 }
 
+get_uri_with_command_server() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      command_server: true
+    }
+  }" | ${resource_dir}/in "$2" | tee /dev/stderr
+}
+
 get_uri_insecure() {
   jq -n "{
     source: {
@@ -466,6 +707,28 @@ get_uri_at_branch() {
   }" | ${resource_dir}/in "$3" | tee /dev/stderr
 }
 
+get_uri_at_ref_on_branch() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      branches: $(echo $4 | jq -R .)
+    },
+    version: {
+      ref: $(echo $2 | jq -R .),
+      branch: $(echo $3 | jq -R .)
+    }
+  }" | ${resource_dir}/in "$5" | tee /dev/stderr
+}
+
+get_uri_at_bookmark() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      bookmark: $(echo $2 | jq -R .)
+    }
+  }" | ${resource_dir}/in "$3" | tee /dev/stderr
+}
+
 put_uri() {
   jq -n "{
     source: {
@@ -528,6 +791,31 @@ put_uri_with_rebase() {
   }" | ${resource_dir}/out "$2" | tee /dev/stderr
 }
 
+put_uri_with_bookmark() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      bookmark: $(echo $3 | jq -R .)
+    },
+    params: {
+      repository: $(echo $4 | jq -R .)
+    }
+  }" | ${resource_dir}/out "$2" | tee /dev/stderr
+}
+
+put_uri_with_bookmark_and_rebase() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      bookmark: $(echo $3 | jq -R .)
+    },
+    params: {
+      repository: $(echo $4 | jq -R .),
+      rebase: true
+    }
+  }" | ${resource_dir}/out "$2" | tee /dev/stderr
+}
+
 put_uri_with_rebase_and_race_conditions() {
   jq -n "{
     source: {
@@ -38,6 +38,28 @@ test_it_can_check_from_a_bogus_sha() {
   assertEquals "$expected" "$(check_uri_from $repo bogus-ref | jq '.')"
 }
 
+test_it_maps_rewritten_versions_to_their_successors() {
+  local repo=$(init_repo)
+  echo -e "[experimental]\nevolution = all" >> $repo/.hg/hgrc
+  local ref1=$(make_commit $repo)
+  local ref2=$(make_commit $repo)
+
+  local expected1=$(echo "[{\"ref\": $(echo $ref2 | jq -R .)}]"|jq ".")
+  assertEquals "$expected1" "$(check_uri_with_evolution $repo | jq '.')"
+
+  # rewrite the version check has emitted
+  echo x >> $repo/some-file
+  hg commit --cwd $repo --amend -q -m "amended"
+  local ref3=$(hg log --cwd $repo --rev . --template '{node}')
+  local ref4=$(make_commit $repo)
+
+  local expected2=$(echo "[
+      {\"ref\": $(echo $ref3 | jq -R .)},
+      {\"ref\": $(echo $ref4 | jq -R .)}
+    ]"|jq ".")
+  assertEquals "$expected2" "$(check_uri_with_evolution_from $repo $ref2 | jq '.')"
+}
+
 test_it_skips_ignored_paths() {
   local repo=$(init_repo)
   local ref1=$(make_commit_to_file $repo file-a)
@@ -118,12 +140,130 @@ test_check_checks_out_expected_branch_after_clone_and_pull() {
   # first check triggers clone
   local expected1=$(echo "[{\"ref\": $(echo $ref1 | jq -R .)}]"|jq ".")
   assertEquals "$expected1" "$(check_uri_with_branch $repo some-branch | jq '.')"
-  assertEquals "some-branch" $(hg branch --cwd $TMPDIR/hg-resource-repo-cache)
+  assertEquals "some-branch" $(hg branch --cwd $(get_cache_dir))
 
   # second check triggers pull
   local expected2=$(echo "[{\"ref\": $(echo $ref1 | jq -R .)}]"|jq ".")
   assertEquals "$expected2" "$(check_uri_with_branch $repo some-branch | jq '.')"
-  assertEquals "some-branch" $(hg branch --cwd $TMPDIR/hg-resource-repo-cache)
+  assertEquals "some-branch" $(hg branch --cwd $(get_cache_dir))
+}
+
+test_it_only_checks_given_phases() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit $repo)
+  local ref2=$(make_commit $repo)
+  local ref3=$(make_commit $repo)
+  local ref4=$(make_commit $repo)
+  hg phase --cwd $repo --public --rev $ref3
+
+  local expected1=$(echo "[{\"ref\": $(echo $ref3 | jq -R .)}]"|jq ".")
+  assertEquals "$expected1" "$(check_uri_with_phases $repo public | jq '.')"
+
+  local expected2=$(echo "[
+      {\"ref\": $(echo $ref2 | jq -R .)},
+      {\"ref\": $(echo $ref3 | jq -R .)}
+    ]"|jq ".")
+  assertEquals "$expected2" "$(check_uri_with_phases_from $repo $ref1 public | jq '.')"
+}
+
+test_it_follows_several_branches() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit_to_branch $repo release/1)
+  local ref2=$(make_commit_to_branch $repo release/2)
+  local ref3=$(make_commit $repo)
+
+  local expected1=$(echo "[
+      {\"ref\": $(echo $ref1 | jq -R .), \"branch\": \"release/1\"},
+      {\"ref\": $(echo $ref2 | jq -R .), \"branch\": \"release/2\"}
+    ]"|jq ".")
+  assertEquals "$expected1" "$(check_uri_with_branches $repo '^release/' | jq '.')"
+
+  local ref4=$(make_commit_to_branch $repo release/1)
+  local ref5=$(make_commit_to_branch $repo release/3)
+
+  local expected2=$(echo "[
+      {\"ref\": $(echo $ref4 | jq -R .), \"branch\": \"release/1\"},
+      {\"ref\": $(echo $ref5 | jq -R .), \"branch\": \"release/3\"}
+    ]"|jq ".")
+  assertEquals "$expected2" "$(check_uri_with_branches_from $repo $ref2 release/2 '^release/' | jq '.')"
+}
+
+test_it_follows_a_bookmark() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit_to_bookmark $repo feature)
+  local ref2=$(make_commit $repo)
+
+  local expected1=$(echo "[{\"ref\": $(echo $ref1 | jq -R .)}]"|jq ".")
+  assertEquals "$expected1" "$(check_uri_with_bookmark $repo feature | jq '.')"
+
+  local ref3=$(make_commit_to_bookmark $repo feature)
+  local ref4=$(make_commit_to_bookmark $repo feature)
+
+  local expected2=$(echo "[
+      {\"ref\": $(echo $ref3 | jq -R .)},
+      {\"ref\": $(echo $ref4 | jq -R .)}
+    ]"|jq ".")
+  assertEquals "$expected2" "$(check_uri_with_bookmark_from $repo $ref1 feature | jq '.')"
+}
+
+test_it_checks_the_remote_head_without_cloning() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit $repo)
+  local ref2=$(make_commit $repo)
+
+  local expected=$(echo "[{\"ref\": $(echo $ref2 | jq -R .)}]"|jq ".")
+  assertEquals "$expected" "$(check_uri_with_ci_skip_disabled $repo | jq '.')"
+
+  ! ls -d $TMPDIR/hg-resource-repo-cache-* &>/dev/null || fail "expected check to not clone the repository"
+}
+
+test_it_checks_the_remote_head_like_a_clone_with_closed_heads() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit $repo)
+  local ref2=$(make_commit $repo)
+
+  # a second head on the branch, closed after the open one
+  hg update --cwd $repo -q $ref1
+  echo x > $repo/other-file
+  hg commit --cwd $repo -q -A -m "other head" --user "test <test@example.com>"
+  hg commit --cwd $repo -q --close-branch -m "close" --user "test <test@example.com>"
+  local ref3=$(hg log --cwd $repo --rev tip --template '{node}')
+
+  local expected=$(echo "[{\"ref\": $(echo $ref3 | jq -R .)}]"|jq ".")
+  assertEquals "$expected" "$(check_uri_with_ci_skip_disabled $repo | jq '.')"
+}
+
+test_it_uses_separate_caches_per_source() {
+  local repo1=$(init_repo)
+  local ref1=$(make_commit $repo1)
+  local repo2=$(init_repo)
+  local ref2=$(make_commit $repo2)
+
+  local expected1=$(echo "[{\"ref\": $(echo $ref1 | jq -R .)}]"|jq ".")
+  assertEquals "$expected1" "$(check_uri $repo1 | jq '.')"
+
+  local expected2=$(echo "[{\"ref\": $(echo $ref2 | jq -R .)}]"|jq ".")
+  assertEquals "$expected2" "$(check_uri $repo2 | jq '.')"
+
+  assertEquals 2 $(ls -d $TMPDIR/hg-resource-repo-cache-* | wc -l)
+}
+
+test_it_reclones_cache_if_uri_changed() {
+  local repo1=$(init_repo)
+  local ref1=$(make_commit $repo1)
+  local repo2=$(init_repo)
+  local ref2=$(make_commit $repo2)
+
+  local expected1=$(echo "[{\"ref\": $(echo $ref1 | jq -R .)}]"|jq ".")
+  assertEquals "$expected1" "$(check_uri $repo1 | jq '.')"
+
+  # simulate a cache that was cloned from a different uri
+  local cachedir=$(get_cache_dir)
+  hg --cwd $cachedir pull -q $repo2
+  echo -e "[paths]\ndefault = $repo2" > $cachedir/.hg/hgrc
+
+  assertEquals "$expected1" "$(check_uri $repo1 | jq '.')"
+  assertEquals "$repo1" "$(hg config --cwd $cachedir paths.default)"
 }
 
 test_it_checks_given_paths() {
@@ -214,7 +354,7 @@ test_it_skips_marked_commits_with_no_version() {
   assertEquals "$expected" "$(check_uri $repo | jq '.')"
 }
 
-test_it_fails_if_key_has_password() {
+test_it_fails_if_key_has_passphrase_but_none_is_given() {
   local repo=$(init_repo)
   local ref=$(make_commit $repo)
 
@@ -226,7 +366,114 @@ test_it_fails_if_key_has_password() {
     fail "checking should have failed"
   fi
 
-  assertEquals "Error running ssh-add: Private keys with passphrases are not supported." "$(cat $failed_output)"
+  assertEquals "Error: private_key is protected by a passphrase, set private_key_passphrase" "$(cat $failed_output)"
+}
+
+test_it_can_check_with_key_that_has_passphrase() {
+  local repo=$(init_repo)
+  local ref=$(make_commit $repo)
+
+  local key=$TMPDIR/key-with-passphrase
+  ssh-keygen -f $key -N some-passphrase
+
+  local expected=$(echo "[{\"ref\": $(echo $ref | jq -R .)}]" | jq ".")
+  assertEquals "$expected" "$(check_uri_with_key_and_passphrase $repo $key some-passphrase | jq '.')"
+}
+
+test_it_skips_commits_matching_custom_patterns() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit $repo)
+  local ref2=$(make_commit_to_file $repo some-file "[skip ci]")
+  local ref3=$(make_commit_to_file $repo some-file "***NO_CI***")
+  local ref4=$(make_commit_to_file $repo some-file "[ci skip]")
+
+  local expected=$(echo "[{\"ref\": $(echo $ref4 | jq -R .)}]" | jq ".")
+  assertEquals "$expected" "$(check_uri_with_skip_ci_patterns_from $repo $ref1 '[skip ci]' 're:\*\*\*NO_CI\*\*\*' | jq '.')"
+}
+
+test_it_can_disable_skipping_marked_commits() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit $repo)
+  local ref2=$(make_commit_to_be_skipped $repo)
+
+  local expected=$(echo "[{\"ref\": $(echo $ref2 | jq -R .)}]" | jq ".")
+  assertEquals "$expected" "$(check_uri_with_ci_skip_disabled_from $repo $ref1 | jq '.')"
+}
+
+test_it_filters_commits_by_author() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit $repo)
+  local ref2=$(make_commit_to_file_on_branch_as_user_at_date $repo some-file default 'Jane Doe <jdoe@example.com>' '2026-01-01 12:00' 'a commit')
+  local ref3=$(make_commit_to_file_on_branch_as_user_at_date $repo some-file default 'release-bot <bot@example.com>' '2026-01-02 12:00' 'a release')
+  local ref4=$(make_commit_to_file_on_branch_as_user_at_date $repo some-file default 'John Doe <john@example.org>' '2026-01-03 12:00' 'another commit')
+
+  local expected=$(echo "[{\"ref\": $(echo $ref2 | jq -R .)}]" | jq ".")
+  assertEquals "$expected" "$(check_uri_with_authors_from $repo $ref1 '@example.com>$' '^release-bot' | jq '.')"
+}
+
+test_it_backfills_from_initial_ref() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit $repo)
+  local ref2=$(make_commit $repo)
+  local ref3=$(make_commit $repo)
+
+  local expected=$(echo "[
+      {\"ref\": $(echo $ref2 | jq -R .)},
+      {\"ref\": $(echo $ref3 | jq -R .)}
+    ]" | jq ".")
+  assertEquals "$expected" "$(check_uri_with_initial_ref $repo $ref2 | jq '.')"
+}
+
+test_it_fails_if_initial_ref_is_not_in_the_repository() {
+  local repo=$(init_repo)
+  local ref=$(make_commit $repo)
+
+  local failed_output=$TMPDIR/failed-output
+  if check_uri_with_initial_ref $repo bogus 2>$failed_output; then
+    fail "checking should have failed"
+  fi
+
+  assertEquals "Error: initial_ref bogus not found in $repo" "$(tail -n 1 $failed_output)"
+}
+
+test_it_backfills_since_date() {
+  local repo=$(init_repo)
+  # dates in the future, as the initial commits are made now
+  local ref1=$(make_commit_to_file_on_branch_as_user_at_date $repo some-file default 'test <test@example.com>' '2100-01-01 12:00' 'old commit')
+  local ref2=$(make_commit_to_file_on_branch_as_user_at_date $repo some-file default 'test <test@example.com>' '2100-01-03 12:00' 'new commit')
+  local ref3=$(make_commit_to_file_on_branch_as_user_at_date $repo some-file default 'test <test@example.com>' '2100-01-04 12:00' 'newer commit')
+
+  local expected=$(echo "[
+      {\"ref\": $(echo $ref2 | jq -R .)},
+      {\"ref\": $(echo $ref3 | jq -R .)}
+    ]" | jq ".")
+  assertEquals "$expected" "$(check_uri_since_date $repo 2100-01-02 | jq '.')"
+}
+
+test_it_can_exclude_merges() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit $repo)
+  local ref2=$(make_commit_to_file_on_branch $repo file-a feature)
+  local ref3=$(make_commit_to_file $repo file-b)
+  local ref4=$(make_merge $repo feature)
+
+  assertEquals "[]" "$(check_uri_with_merges_from_paths $repo $ref3 exclude | jq -c '.')"
+}
+
+test_it_matches_merges_against_first_parent() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit $repo)
+  local ref2=$(make_commit_to_file_on_branch $repo file-a feature)
+  local ref3=$(make_commit_to_file $repo file-b)
+  local ref4=$(make_merge $repo feature)
+
+  # the merge brings changes to file-a onto the tracked branch
+  local expected1=$(echo "[{\"ref\": $(echo $ref4 | jq -R .)}]" | jq ".")
+  assertEquals "$expected1" "$(check_uri_with_merges_from_paths $repo $ref3 first_parent file-a | jq '.')"
+
+  # file-b was already changed on the tracked branch before the merge
+  local expected2=$(echo "[{\"ref\": $(echo $ref3 | jq -R .)}]" | jq ".")
+  assertEquals "$expected2" "$(check_uri_with_merges_from_paths $repo $ref1 first_parent file-b | jq '.')"
 }
 
 test_it_can_check_with_tag_filter() {
@@ -266,6 +513,16 @@ test_it_can_check_with_revset_filter() {
   assertEquals "$expected" "$(check_uri_with_revset_filter $repo 'tag("re:-staging$")' | jq '.')"
 }
 
+test_it_can_check_with_revset_filter_containing_quotes() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit $repo)
+  local ref2=$(make_annotated_tag $repo "1.0-staging" "a tag")
+  local ref3=$(make_commit $repo)
+
+  local expected=$(echo "[{\"ref\": $(echo $ref1 | jq -R .)}]" | jq ".")
+  assertEquals "$expected" "$(check_uri_with_revset_filter $repo "tag('re:-staging\$')" | jq '.')"
+}
+
 test_it_can_check_with_revset_filter_from_a_ref() {
   local repo=$(init_repo)
   local ref1=$(make_commit $repo)
@@ -282,11 +539,12 @@ test_it_can_check_with_revset_filter_from_a_ref() {
 test_it_can_check_from_head_only_fetching_single_branch() {
   local repo=$(init_repo)
   local ref=$(make_commit $repo)
-  local cachedir="$TMPDIR/hg-resource-repo-cache"
   
   local expected=$(echo "[{\"ref\": $(echo $ref | jq -R .)}]" | jq ".")
   assertEquals "$expected" "$(check_uri $repo | jq '.')"
   
+  # the cache only exists once the check created it
+  local cachedir=$(get_cache_dir)
   ! check_branch_exists "$cachedir" bogus || fail "branch was fetched, expected it to not exist locally"
 }
 
@@ -24,6 +24,20 @@ test_it_can_get_from_url() {
   assertEquals "$ref" "$(get_working_dir_ref $dest)"
 }
 
+test_it_can_get_from_url_with_command_server() {
+  local repo=$(init_repo)
+  local ref=$(make_commit $repo)
+  local dest=$TMPDIR/destination
+
+  local expected=$(echo "{\"ref\": $(echo $ref | jq -R .)}" | jq ".")
+  assertEquals "$expected" "$(get_uri_with_command_server $repo $dest | jq '.version')"
+
+  if [ ! -e "$dest/some-file" ]; then
+    fail "expected some-file to exist in the working directory"
+  fi
+  assertEquals "$ref" "$(get_working_dir_ref $dest)"
+}
+
 test_it_can_get_from_url_at_ref() {
   local repo=$(init_repo)
   local ref1=$(make_commit $repo)
@@ -126,6 +140,39 @@ test_it_updates_subrepositories() {
   fi
 }
 
+test_it_can_get_from_url_at_ref_on_branch() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit_to_branch $repo release/1)
+  local ref2=$(make_commit_to_branch $repo release/2)
+
+  local dest=$TMPDIR/destination
+
+  local expected=$(echo "{\"ref\": $(echo $ref1 | jq -R .), \"branch\": \"release/1\"}" | jq ".")
+  assertEquals "$expected" "$(get_uri_at_ref_on_branch $repo $ref1 release/1 '^release/' $dest | jq '.version')"
+  assertEquals "$ref1" "$(get_working_dir_ref $dest)"
+}
+
+test_it_can_get_from_url_at_bookmark() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit_to_bookmark $repo feature)
+  local ref2=$(make_commit $repo)
+
+  local dest=$TMPDIR/destination
+
+  local expected=$(echo "{\"ref\": $(echo $ref1 | jq -R .)}" | jq ".")
+  assertEquals "$expected" "$(get_uri_at_bookmark $repo feature $dest | jq '.version')"
+  assertEquals "$ref1" "$(get_working_dir_ref $dest)"
+}
+
+test_it_reports_versions_missing_from_the_repository() {
+  local repo=$(init_repo)
+  local ref=$(make_commit $repo)
+  local dest=$TMPDIR/destination
+
+  ! get_uri_at_ref $repo 0123456789abcdef0123456789abcdef01234567 $dest 2> $TMPDIR/stderr || fail "expected getting a missing version to fail"
+  grep -q "is not in the repository" $TMPDIR/stderr || fail "expected the missing version to be reported"
+}
+
 test_it_checks_ssl_certificates() {
   local repo=$(init_repo)
   local ref=$(make_commit $repo)
@@ -155,6 +155,52 @@ test_it_can_put_to_url_with_rebase() {
   assertEquals "$baseref" "$parent_of_tip"
 }
 
+test_it_can_put_to_url_with_bookmark() {
+  local repo1=$(init_repo)
+  local baseref=$(make_commit_to_bookmark $repo1 feature)
+
+  local src=$(mktemp -d $TMPDIR/put-src.XXXXXX)
+  local repo2=$src/repo
+  hg clone $repo1 $repo2
+  hg checkout -q --cwd $repo2 feature
+
+  local ref=$(make_commit_to_bookmark $repo2 feature)
+  hg bookmark --cwd $repo2 --inactive
+
+  put_uri_with_bookmark $repo1 $src feature repo | jq -e "
+    .version == {ref: $(echo $ref | jq -R .)}
+  "
+
+  assertEquals "$ref" "$(hg log --cwd $repo1 --rev 'bookmark(feature)' --template '{node}')"
+}
+
+test_it_can_put_to_url_with_bookmark_and_rebase() {
+  local repo1=$(init_repo)
+  local baseref=$(make_commit_to_bookmark $repo1 feature)
+
+  local src=$(mktemp -d $TMPDIR/put-src.XXXXXX)
+  local repo2=$src/repo
+  hg clone $repo1 $repo2
+
+  # move the bookmark in a way that requires rebasing
+  local otherref=$(make_commit_to_bookmark $repo1 feature)
+
+  hg checkout -q --cwd $repo2 feature
+  local ref=$(make_commit_to_bookmark $repo2 feature)
+  hg bookmark --cwd $repo2 --inactive
+
+  local response=$(mktemp $TMPDIR/rebased-response.XXXXXX)
+  put_uri_with_bookmark_and_rebase $repo1 $src feature repo > $response
+
+  local bookmarked_ref=$(hg log --cwd $repo1 --rev 'bookmark(feature)' --template '{node}')
+  jq -e "
+    .version == {ref: $(echo $bookmarked_ref | jq -R .)}
+  " < $response
+
+  local parent_of_bookmark=$(hg log --cwd $repo1 --rev 'bookmark(feature)^' --template '{node}')
+  assertEquals "$otherref" "$parent_of_bookmark"
+}
+
 test_it_can_put_to_url_with_rebase_with_tag() {
   local repo1=$(init_repo)
 